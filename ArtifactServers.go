@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type nexusSearchPage struct {
+	Items []struct {
+		Repository string `json:"repository"`
+		Format     string `json:"format"`
+		Group      string `json:"group"`
+		Name       string `json:"name"`
+		Version    string `json:"version"`
+		Assets     []struct {
+			DownloadUrl  string `json:"downloadUrl"`
+			Path         string `json:"path"`
+			LastModified string `json:"lastModified"`
+		} `json:"assets"`
+	} `json:"items"`
+	ContinuationToken string `json:"continuationToken"`
+}
+
+type artifactoryAqlResult struct {
+	Results []struct {
+		Repo     string `json:"repo"`
+		Path     string `json:"path"`
+		Name     string `json:"name"`
+		Modified string `json:"modified"`
+	} `json:"results"`
+}
+
+// artifactoryAql finds the maven poms, jars and wars and the npm packages of a
+// repository. %q is the repository.
+const artifactoryAql = `items.find({"repo":%q,"$or":[` +
+	`{"name":{"$match":"*.pom"}},{"name":{"$match":"*.jar"}},` +
+	`{"name":{"$match":"*.war"}},{"name":{"$match":"*.tgz"}}` +
+	`]}).include("repo","path","name","modified")`
+
+// listNexusFiles uses the search api, which also works for repository groups
+func (a *ArtifactsModule) listNexusFiles(repository string) ([]artifactFile, error) {
+	var files []artifactFile
+	query := url.Values{}
+	query.Set("repository", repository)
+	for {
+		var page nexusSearchPage
+		if _, err := a.api.GetJson(a.httpUrl+"/service/rest/v1/search?"+query.Encode(), &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			file := artifactFile{
+				RepositoryArtifact: RepositoryArtifact{
+					Repository: repository,
+					Format:     item.Format,
+					Group:      item.Group,
+					Name:       item.Name,
+				},
+				ArtifactVersion: ArtifactVersion{Version: item.Version},
+			}
+			for _, asset := range item.Assets {
+				if isChecksumOrSignature(asset.Path) || item.Format == "maven2" && !isMainMavenFile(item.Name, item.Version, path.Base(asset.Path)) {
+					continue
+				}
+				// Prefer the artifact itself over the pom
+				if file.DownloadUrl == "" || strings.HasSuffix(file.DownloadUrl, ".pom") {
+					file.DownloadUrl = asset.DownloadUrl
+					file.Updated = asset.LastModified
+				}
+			}
+			files = append(files, file)
+		}
+		if page.ContinuationToken == "" {
+			return files, nil
+		}
+		query.Set("continuationToken", page.ContinuationToken)
+	}
+}
+
+func isChecksumOrSignature(fileName string) bool {
+	for _, suffix := range []string{".md5", ".sha1", ".sha256", ".sha512", ".asc"} {
+		if strings.HasSuffix(fileName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// listArtifactoryFiles uses AQL, which only works for local and remote
+// repositories, not for virtual ones.
+func (a *ArtifactsModule) listArtifactoryFiles(repository string) ([]artifactFile, error) {
+	var result artifactoryAqlResult
+	req, err := http.NewRequest("POST", a.httpUrl+"/api/search/aql", strings.NewReader(fmt.Sprintf(artifactoryAql, repository)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	response, err := a.api.Do(req, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(response.Body, &result); err != nil {
+		return nil, err
+	}
+	var files []artifactFile
+	for _, item := range result.Results {
+		file, ok := artifactoryFile(item.Path, item.Name)
+		if !ok {
+			continue
+		}
+		file.Repository = repository
+		file.DownloadUrl = a.httpUrl + "/" + item.Repo + "/" + item.Path + "/" + item.Name
+		file.Updated = item.Modified
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// artifactoryFile derives the artifact from the location of a file. Maven
+// files are at group/path/name/version/name-version.ext, npm packages at
+// @scope/name/-/name-version.tgz.
+func artifactoryFile(folder string, fileName string) (artifactFile, bool) {
+	var file artifactFile
+	segments := strings.Split(folder, "/")
+	if strings.HasSuffix(fileName, ".tgz") && len(segments) >= 2 && segments[len(segments)-1] == "-" {
+		file.Format = "npm"
+		file.Name = segments[len(segments)-2]
+		if len(segments) == 3 && strings.HasPrefix(segments[0], "@") {
+			file.Group = strings.TrimPrefix(segments[0], "@")
+		}
+		file.Version = strings.TrimSuffix(strings.TrimPrefix(fileName, file.Name+"-"), ".tgz")
+		file.preferred = true
+		return file, file.Version != fileName
+	}
+	if len(segments) < 3 {
+		return file, false
+	}
+	file.Format = "maven2"
+	file.Name = segments[len(segments)-2]
+	file.Version = segments[len(segments)-1]
+	file.Group = strings.Join(segments[:len(segments)-2], ".")
+	if !isMainMavenFile(file.Name, file.Version, fileName) {
+		return file, false
+	}
+	file.preferred = path.Ext(fileName) != ".pom"
+	return file, true
+}
+
+// isMainMavenFile is false for files with classifiers like sources or javadoc
+func isMainMavenFile(name string, version string, fileName string) bool {
+	return fileName == name+"-"+version+path.Ext(fileName)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ArtifactsModule indexes the maven and npm artifacts in configured
+// repositories of a nexus or artifactory server.
+type ArtifactsModule struct {
+	serverType   string
+	httpUrl      string
+	username     string
+	password     string
+	token        string
+	repositories []string
+	maxVersions  int
+	api          *ApiClient
+	artifacts    []RepositoryArtifact
+}
+
+type RepositoryArtifact struct {
+	Repository string `json:"repository"`
+	// Format is maven2 or npm. Nexus knows some more.
+	Format string `json:"format"`
+	// Group is the maven group id or the npm scope without the @
+	Group string `json:"group"`
+	Name  string `json:"name"`
+	// Versions are the latest versions, newest first
+	Versions []ArtifactVersion `json:"versions"`
+}
+
+type ArtifactVersion struct {
+	Version     string `json:"version"`
+	DownloadUrl string `json:"downloadUrl"`
+	Updated     string `json:"updated"`
+}
+
+// artifactFile is a file of an artifact version as listed by the server
+type artifactFile struct {
+	RepositoryArtifact
+	ArtifactVersion
+	// preferred files are the artifact itself, eg. the jar instead of the pom
+	preferred bool
+}
+
+const (
+	nexusServer       = "nexus"
+	artifactoryServer = "artifactory"
+)
+
+func NewArtifactsModule() *ArtifactsModule {
+	return new(ArtifactsModule)
+}
+
+func (a *ArtifactsModule) Name() string {
+	return "Artifacts"
+}
+
+func (a *ArtifactsModule) Description() string {
+	return "Provides access to artifacts in nexus or artifactory"
+}
+
+func (a *ArtifactsModule) CanBeDisabled() bool {
+	return true
+}
+
+func (a *ArtifactsModule) UpdateSettings() {
+	configKey := a.Name() + ".type"
+	a.serverType = viper.GetString(configKey)
+	if a.serverType != nexusServer && a.serverType != artifactoryServer {
+		log.Fatalf("Missing or invalid configuration key `%s` (eg. '%s' or '%s')", configKey, nexusServer, artifactoryServer)
+	}
+
+	configKey = a.Name() + ".http-url"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'https://nexus.example.com')", configKey)
+	}
+	a.httpUrl = strings.TrimSuffix(viper.GetString(configKey), "/")
+
+	configKey = a.Name() + ".repositories"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. '[maven-public, npm-internal]')", configKey)
+	}
+	a.repositories = viper.GetStringSlice(configKey)
+
+	// Anonymous access works if neither a password nor a token is set
+	a.username = viper.GetString(a.Name() + ".username")
+	a.password = viper.GetString(a.Name() + ".password")
+	a.token = viper.GetString(a.Name() + ".token")
+	a.maxVersions = 10
+	if configKey = a.Name() + ".max-versions"; viper.IsSet(configKey) {
+		a.maxVersions = viper.GetInt(configKey)
+	}
+	var auth func(req *http.Request)
+	if a.token != "" {
+		auth = BearerAuth(a.token)
+	} else if a.password != "" {
+		auth = BasicAuth(a.username, a.password)
+	}
+	a.api = NewApiClient(a.Name(), auth)
+}
+
+func (a *ArtifactsModule) NeedsExternalData() bool {
+	return true
+}
+
+func (a *ArtifactsModule) UpdateExternalData() {
+	var artifacts []RepositoryArtifact
+	for _, repository := range a.repositories {
+		var files []artifactFile
+		var err error
+		if a.serverType == nexusServer {
+			files, err = a.listNexusFiles(repository)
+		} else {
+			files, err = a.listArtifactoryFiles(repository)
+		}
+		if err != nil {
+			log.Fatalf("Cannot list artifacts of repository %s: %v", repository, err)
+		}
+		repositoryArtifacts := a.groupArtifactFiles(files)
+		fmt.Printf("  - %d artifacts in repository %s\n", len(repositoryArtifacts), repository)
+		artifacts = append(artifacts, repositoryArtifacts...)
+	}
+	a.artifacts = artifacts
+}
+
+// groupArtifactFiles collects the versions of each artifact and keeps the
+// newest ones.
+func (a *ArtifactsModule) groupArtifactFiles(files []artifactFile) []RepositoryArtifact {
+	var artifacts []RepositoryArtifact
+	artifactIndex := make(map[string]int)
+	versionIndex := make(map[string]int)
+	for _, file := range files {
+		artifactKey := file.Format + ":" + file.Group + ":" + file.Name
+		i, known := artifactIndex[artifactKey]
+		if !known {
+			i = len(artifacts)
+			artifactIndex[artifactKey] = i
+			artifacts = append(artifacts, file.RepositoryArtifact)
+		}
+		versionKey := artifactKey + ":" + file.Version
+		if v, known := versionIndex[versionKey]; !known {
+			versionIndex[versionKey] = len(artifacts[i].Versions)
+			artifacts[i].Versions = append(artifacts[i].Versions, file.ArtifactVersion)
+		} else if file.preferred {
+			artifacts[i].Versions[v] = file.ArtifactVersion
+		}
+	}
+	for i := range artifacts {
+		versions := artifacts[i].Versions
+		sort.SliceStable(versions, func(x, y int) bool {
+			return compareVersions(versions[x].Version, versions[y].Version) > 0
+		})
+		if a.maxVersions > 0 && len(versions) > a.maxVersions {
+			artifacts[i].Versions = versions[:a.maxVersions]
+		}
+	}
+	return artifacts
+}
+
+var versionPartPattern = regexp.MustCompile(`[0-9]+|[^0-9.\-_+]+`)
+
+// compareVersions compares numeric parts as numbers and everything else as
+// text. A qualifier makes a version older, eg. 1.0-rc1 is older than 1.0.
+func compareVersions(a string, b string) int {
+	aParts := versionPartPattern.FindAllString(a, -1)
+	bParts := versionPartPattern.FindAllString(b, -1)
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		if i >= len(aParts) {
+			return -compareVersionRest(bParts[i])
+		}
+		if i >= len(bParts) {
+			return compareVersionRest(aParts[i])
+		}
+		aNumber, aErr := strconv.Atoi(aParts[i])
+		bNumber, bErr := strconv.Atoi(bParts[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNumber != bNumber {
+				return aNumber - bNumber
+			}
+		case aErr == nil:
+			return 1
+		case bErr == nil:
+			return -1
+		default:
+			if c := strings.Compare(strings.ToLower(aParts[i]), strings.ToLower(bParts[i])); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+// compareVersionRest compares a version that has more parts to one that ends
+// just before part
+func compareVersionRest(part string) int {
+	if _, err := strconv.Atoi(part); err == nil {
+		return 1
+	}
+	return -1
+}
+
+func (a *ArtifactsModule) WriteExternalData(file *os.File) {
+	bytes, err := json.Marshal(a.artifacts)
+	if err != nil {
+		log.Fatalf("Cannot serialize artifacts: %s", err)
+	}
+	if _, err = file.Write(bytes); err != nil {
+		log.Fatalf("Cannot write artifacts to %v: %s", file, err)
+	}
+}
+
+func (a *ArtifactsModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &a.artifacts)
+}
+
+// Coordinates are eg. com.example:library or @example/library
+func (a RepositoryArtifact) Coordinates() string {
+	switch {
+	case a.Format == "npm" && a.Group != "":
+		return "@" + a.Group + "/" + a.Name
+	case a.Group != "":
+		return a.Group + ":" + a.Name
+	default:
+		return a.Name
+	}
+}
+
+func (a RepositoryArtifact) Latest() string {
+	if len(a.Versions) == 0 {
+		return ""
+	}
+	return a.Versions[0].Version
+}
+
+// folder is the path of the artifact in the repository
+func (a RepositoryArtifact) folder() string {
+	if a.Format == "maven2" {
+		return strings.ReplaceAll(a.Group, ".", "/") + "/" + a.Name
+	}
+	return strings.TrimPrefix(a.Coordinates(), "@")
+}
+
+func (a *ArtifactsModule) browseUrl(artifact RepositoryArtifact) string {
+	if a.serverType == nexusServer {
+		return a.httpUrl + "/#browse/browse:" + artifact.Repository + ":" + strings.ReplaceAll(artifact.folder(), "/", "%2F")
+	}
+	// The ui is a sibling of the artifactory context
+	return strings.TrimSuffix(a.httpUrl, "/artifactory") + "/ui/repos/tree/General/" + artifact.Repository + "/" + artifact.folder()
+}
+
+type ArtifactBrowseAction struct {
+	artifact RepositoryArtifact
+	url      string
+}
+
+func (a ArtifactBrowseAction) GetLabel() string {
+	return "[artifacts[] BROWSE " + a.artifact.Coordinates() + " (" + a.artifact.Latest() + ")"
+}
+
+func (a ArtifactBrowseAction) Run() string {
+	if err := launchUrl(a.url); err != nil {
+		log.Fatalf("Could not browse %s: %v", a.url, err)
+	}
+	return "Opened " + a.url
+}
+
+type ArtifactSnippetAction struct {
+	artifact RepositoryArtifact
+	// tool is maven, gradle or npm
+	tool string
+}
+
+func (a ArtifactSnippetAction) GetLabel() string {
+	return "[artifacts[] " + strings.ToUpper(a.tool) + " " + a.artifact.Coordinates() + ":" + a.artifact.Latest()
+}
+
+func (a ArtifactSnippetAction) snippet() string {
+	version := a.artifact.Latest()
+	switch a.tool {
+	case "maven":
+		return "<dependency>\n" +
+			"    <groupId>" + a.artifact.Group + "</groupId>\n" +
+			"    <artifactId>" + a.artifact.Name + "</artifactId>\n" +
+			"    <version>" + version + "</version>\n" +
+			"</dependency>"
+	case "gradle":
+		return "implementation '" + a.artifact.Group + ":" + a.artifact.Name + ":" + version + "'"
+	default:
+		return `"` + a.artifact.Coordinates() + `": "` + version + `"`
+	}
+}
+
+// Run copies the snippet. Without a clipboard, it is printed instead.
+func (a ArtifactSnippetAction) Run() string {
+	snippet := a.snippet()
+	if err := copyToClipboard(snippet); err != nil {
+		return snippet
+	}
+	return "Copied " + a.tool + " dependency on " + a.artifact.Coordinates() + ":" + a.artifact.Latest()
+}
+
+type ArtifactDownloadAction struct {
+	artifact        RepositoryArtifact
+	artifactsModule *ArtifactsModule
+}
+
+func (a ArtifactDownloadAction) GetLabel() string {
+	return "[artifacts[] DOWNLOAD " + a.artifact.Coordinates() + " (" + a.artifact.Latest() + ")"
+}
+
+// Run asks for the version and downloads it into the current directory
+func (a ArtifactDownloadAction) Run() string {
+	var versions []string
+	for _, version := range a.artifact.Versions {
+		versions = append(versions, version.Version)
+	}
+	fmt.Println("Versions: " + strings.Join(versions, ", "))
+	chosen := prompt("Version:", a.artifact.Latest())
+	for _, version := range a.artifact.Versions {
+		if version.Version == chosen {
+			fileName, err := a.artifactsModule.Download(version.DownloadUrl)
+			if err != nil {
+				log.Fatalf("Could not download %s: %v", version.DownloadUrl, err)
+			}
+			return "Downloaded " + fileName
+		}
+	}
+	return "Unknown version " + chosen
+}
+
+// downloadFileName is the last path segment of the download url
+func downloadFileName(downloadUrl string) (string, error) {
+	parsedUrl, err := url.Parse(downloadUrl)
+	if err != nil {
+		return "", err
+	}
+	fileName := path.Base(parsedUrl.Path)
+	if fileName == "." || fileName == "/" {
+		return "", fmt.Errorf("no file name in download url `%s`", downloadUrl)
+	}
+	return fileName, nil
+}
+
+// Download saves the file in the current directory
+func (a *ArtifactsModule) Download(downloadUrl string) (string, error) {
+	fileName, err := downloadFileName(downloadUrl)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(fileName); err == nil && !confirm(fileName+" exists. Overwrite?") {
+		return "", fmt.Errorf("%s exists", fileName)
+	}
+	req, err := http.NewRequest("GET", downloadUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.api.Open(req)
+	if err != nil {
+		return "", err
+	}
+	defer closeResponseBody(resp)
+	file, err := os.Create(fileName)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(file, resp.Body); err != nil {
+		_ = file.Close()
+		return "", err
+	}
+	return fileName, file.Close()
+}
+
+func (a *ArtifactsModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	for _, artifact := range a.artifacts {
+		if len(artifact.Versions) == 0 {
+			continue
+		}
+		strs := []string{"artifact", artifact.Repository, artifact.Format, artifact.Group, artifact.Name, artifact.Coordinates()}
+		for _, version := range artifact.Versions {
+			strs = append(strs, version.Version)
+		}
+		if DoMatch(append(strs, "browse"), tags) {
+			actions = append(actions, ArtifactBrowseAction{artifact: artifact, url: a.browseUrl(artifact)})
+		}
+		var tools []string
+		switch artifact.Format {
+		case "maven2":
+			tools = []string{"maven", "gradle"}
+		case "npm":
+			tools = []string{"npm"}
+		}
+		for _, tool := range tools {
+			if DoMatch(append(strs, tool, "snippet", "dependency"), tags) {
+				actions = append(actions, ArtifactSnippetAction{artifact: artifact, tool: tool})
+			}
+		}
+		if artifact.Versions[0].DownloadUrl != "" && DoMatch(append(strs, "download"), tags) {
+			actions = append(actions, ArtifactDownloadAction{artifact: artifact, artifactsModule: a})
+		}
+	}
+	return actions
+}
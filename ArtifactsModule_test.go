@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.10", "1.9", 1},
+		{"1.9", "1.10", -1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.0.1", "1.0", 1},
+		{"1.0", "1.0.1", -1},
+		{"1.0-rc1", "1.0", -1},
+		{"1.0", "1.0-rc1", 1},
+		{"1.0-SNAPSHOT", "1.0", -1},
+		{"1.0-rc1", "1.0-rc2", -1},
+		{"1.0-RC1", "1.0-rc1", 0},
+		{"1.0-alpha", "1.0-beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.Final", "1.0", -1},
+		{"2020.12.1", "2020.9.30", 1},
+		{"1.0_2", "1.0-2", 0},
+		{"1.0.0+build5", "1.0.0", -1},
+		{"", "1.0", -1},
+	}
+	for _, test := range tests {
+		got := compareVersions(test.a, test.b)
+		if sign(got) != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func TestGroupArtifactFiles(t *testing.T) {
+	file := func(name string, version string, downloadUrl string, preferred bool) artifactFile {
+		return artifactFile{
+			RepositoryArtifact: RepositoryArtifact{Repository: "maven-releases", Format: "maven2", Group: "com.example", Name: name},
+			ArtifactVersion:    ArtifactVersion{Version: version, DownloadUrl: downloadUrl},
+			preferred:          preferred,
+		}
+	}
+	module := ArtifactsModule{maxVersions: 3}
+	artifacts := module.groupArtifactFiles([]artifactFile{
+		file("payment", "1.9.0", "https://nexus/payment-1.9.0.pom", false),
+		file("payment", "1.9.0", "https://nexus/payment-1.9.0.jar", true),
+		file("payment", "1.10.0", "https://nexus/payment-1.10.0.jar", true),
+		file("payment", "1.10.0-rc1", "https://nexus/payment-1.10.0-rc1.jar", true),
+		file("payment", "1.8.2", "https://nexus/payment-1.8.2.jar", true),
+		file("billing", "0.1.0", "https://nexus/billing-0.1.0.jar", true),
+	})
+	if len(artifacts) != 2 {
+		t.Fatalf("groupArtifactFiles() returned %d artifacts, want 2", len(artifacts))
+	}
+	want := []ArtifactVersion{
+		{Version: "1.10.0", DownloadUrl: "https://nexus/payment-1.10.0.jar"},
+		{Version: "1.10.0-rc1", DownloadUrl: "https://nexus/payment-1.10.0-rc1.jar"},
+		{Version: "1.9.0", DownloadUrl: "https://nexus/payment-1.9.0.jar"},
+	}
+	if !reflect.DeepEqual(artifacts[0].Versions, want) {
+		t.Errorf("versions of payment = %+v, want %+v", artifacts[0].Versions, want)
+	}
+}
+
+func TestDownloadFileName(t *testing.T) {
+	tests := []struct {
+		downloadUrl string
+		want        string
+		wantErr     bool
+	}{
+		{"https://nexus.example.com/repository/maven-releases/com/example/payment/1.0/payment-1.0.jar", "payment-1.0.jar", false},
+		{"https://nexus.example.com/repository/npm/@acme/ui/-/ui-2.1.0.tgz?download=true", "ui-2.1.0.tgz", false},
+		{"", "", true},
+		{"https://nexus.example.com", "", true},
+		{"https://nexus.example.com/", "", true},
+	}
+	for _, test := range tests {
+		got, err := downloadFileName(test.downloadUrl)
+		if (err != nil) != test.wantErr {
+			t.Errorf("downloadFileName(%q) error = %v, wantErr %v", test.downloadUrl, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("downloadFileName(%q) = %q, want %q", test.downloadUrl, got, test.want)
+		}
+	}
+}
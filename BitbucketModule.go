@@ -5,25 +5,33 @@ import (
 	"fmt"
 	"github.com/ktrysmt/go-bitbucket"
 	"github.com/spf13/viper"
-	"io/ioutil"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
-	"reflect"
 	"strings"
-	"sync"
 )
 
 type BitbucketModule struct {
+	apiUrl                 string
 	username               string
 	password               string
+	api                    *ApiClient
+	cloneSettings          CloneSettings
+	pipelines              bool
+	refs                   bool
+	readmeMaxSize          int
 	repositoriesWithReadme []BitbucketRepositoryWithReadme
 	notificationModule     *DelegatingNotificationsModule
 }
 
+// BitbucketRepositoryWithReadme adds the bitbucket cloud specific data to the
+// shared repository model
 type BitbucketRepositoryWithReadme struct {
-	Repository bitbucket.Repository `json:"repository"`
-	Readme     string               `json:"readme"`
+	HostedRepository
+	// Pipelines holds the latest pipeline per branch
+	Pipelines []BitbucketPipeline `json:"pipelines,omitempty"`
+	// Refs are only loaded if enabled
+	Refs *BitbucketRefs `json:"refs,omitempty"`
 }
 
 func NewBitbucketModule(notificationModule *DelegatingNotificationsModule) *BitbucketModule {
@@ -56,288 +64,293 @@ func (b *BitbucketModule) UpdateSettings() {
 		log.Fatalf("Missing configuration key `%s` (eg. 'mypassword')", configKey)
 	}
 	b.password = viper.GetString(configKey)
+
+	b.apiUrl = bitbucket.NewBasicAuth(b.username, b.password).GetApiBaseURL()
+	if configKey = b.Name() + ".api-url"; viper.IsSet(configKey) {
+		b.apiUrl = strings.TrimSuffix(viper.GetString(configKey), "/")
+	}
+	b.api = NewApiClient(b.Name(), BasicAuth(b.username, b.password))
+	b.cloneSettings = ReadCloneSettings(b.Name(), "ssh")
+	b.pipelines = viper.GetBool(b.Name() + ".pipelines")
+	b.refs = viper.GetBool(b.Name() + ".refs")
+	b.readmeMaxSize = readReadmeMaxSize(b.Name())
 }
 
 func (b *BitbucketModule) NeedsExternalData() bool {
 	return true
 }
 
-func (b *BitbucketModule) LoadRepositories() []bitbucket.Repository {
+func (b *BitbucketModule) Label() string {
+	return "[bitbucket[]"
+}
+
+func (b *BitbucketModule) Keywords() []string {
+	return []string{"bitbucket", "bitbucket-cloud"}
+}
+
+func (b *BitbucketModule) CloneSettings() CloneSettings {
+	return b.cloneSettings
+}
+
+func (b *BitbucketModule) ListRepositories() ([]HostedRepository, error) {
 	client := bitbucket.NewBasicAuth(b.username, b.password)
+	client.SetApiBaseURL(b.apiUrl)
 	workspaces, err := client.Workspaces.List()
-
 	if err != nil {
-		log.Fatalf("Cannot list workspaces: %v", err)
+		return nil, fmt.Errorf("cannot list workspaces: %v", err)
 	}
 
-	numWorkspaces := len(workspaces.Workspaces)
-	var wg sync.WaitGroup
-	wg.Add(numWorkspaces)
-	queue := make(chan []bitbucket.Repository, 1)
-	for i := 0; i < numWorkspaces; i++ {
-		go func(i int) {
-			workspace := workspaces.Workspaces[i]
-			optr := &bitbucket.RepositoriesOptions{
-				Owner: workspace.Slug,
-				Role:  "",
-			}
-
-			repositories, err := client.Repositories.ListForAccount(optr)
-			if err != nil {
-				log.Fatalf("Cannot get repositories for %s; %v", workspace.UUID, err)
-			}
-			fmt.Printf("  - %d repositories in team %v\n", len(repositories.Items), workspace.Name)
-			queue <- repositories.Items
-		}(i)
-	}
-	var allRepositories []bitbucket.Repository
-	go func() {
-		for t := range queue {
-			allRepositories = append(allRepositories, t...)
-			wg.Done()
+	repositoriesPerWorkspace := make([][]HostedRepository, len(workspaces.Workspaces))
+	forEachConcurrently(len(workspaces.Workspaces), func(i int) {
+		workspace := workspaces.Workspaces[i]
+		listings, total, err := b.listWorkspaceRepositories(workspace.Slug)
+		if err != nil {
+			log.Fatalf("Cannot get repositories for %s; %v", workspace.UUID, err)
 		}
-	}()
-	wg.Wait()
-	return allRepositories
+		if len(listings) != total {
+			fmt.Printf("  ! Got %d of %d repositories in team %v\n", len(listings), total, workspace.Name)
+		} else {
+			fmt.Printf("  - %d repositories in team %v\n", total, workspace.Name)
+		}
+		for _, listing := range listings {
+			repositoriesPerWorkspace[i] = append(repositoriesPerWorkspace[i], hostedBitbucketRepository(listing))
+		}
+	})
+	var allRepositories []HostedRepository
+	for _, repositories := range repositoriesPerWorkspace {
+		allRepositories = append(allRepositories, repositories...)
+	}
+	return allRepositories, nil
 }
 
-func (b *BitbucketModule) LoadReadmes(repositories []bitbucket.Repository) []BitbucketRepositoryWithReadme {
-	numRepositories := len(repositories)
-	var wg sync.WaitGroup
-	wg.Add(numRepositories)
-	queue := make(chan BitbucketRepositoryWithReadme, 1)
-	for i := 0; i < numRepositories; i++ {
-		go func(i int) {
-			repository := repositories[i]
-			readme, _ := b.GetReadmeText(repository)
-			queue <- BitbucketRepositoryWithReadme{
-				Repository: repository,
-				Readme:     readme,
-			}
-		}(i)
+// hostedBitbucketRepository maps a bitbucket api repository to the shared
+// model. Missing links are built from the full name.
+func hostedBitbucketRepository(listing BitbucketRepositoryListing) HostedRepository {
+	repository := listing.Repository
+	repo := HostedRepository{
+		Name:          repository.Name,
+		FullName:      repository.Full_name,
+		Project:       repository.Project.Name,
+		ProjectKey:    repository.Project.Key,
+		Slug:          repository.Slug,
+		DefaultBranch: repository.Mainbranch.Name,
+		WebUrl:        "https://bitbucket.org/" + repository.Full_name,
+		CloneLinks:    bitbucketCloudCloneLinks(repository.Full_name),
+		Host:          "bitbucket.org",
+		Workspace:     strings.Split(repository.Full_name, "/")[0],
+		UpdatedOn:     listing.UpdatedOn,
 	}
-	var repositoriesWithReadmes []BitbucketRepositoryWithReadme
-	go func() {
-		for t := range queue {
-			repositoriesWithReadmes = append(repositoriesWithReadmes, t)
-			wg.Done()
+	links, err := ParseBitbucketRepositoryLinks(repository)
+	if err != nil {
+		fmt.Printf("  ! %v\n", err)
+		return repo
+	}
+	if links.Html.Href != "" {
+		repo.WebUrl = links.Html.Href
+	}
+	if len(links.Clone) > 0 {
+		repo.CloneLinks = nil
+		for _, link := range links.Clone {
+			repo.CloneLinks = append(repo.CloneLinks, CloneLink{Name: link.Name, Href: link.Href})
 		}
-	}()
-	wg.Wait()
-	return repositoriesWithReadmes
+	}
+	return repo
 }
 
-func (b *BitbucketModule) GetReadmeText(repository bitbucket.Repository) (string, error) {
-	// Haha, I'm sure its not me that messed up. Thats the beauty of golang :D
-	iter := reflect.ValueOf(repository.Links["self"]).MapRange()
-	var selfLink string
-	for iter.Next() {
-		selfLink = iter.Value().Interface().(string)
-		break
-	}
-	var srcLink = selfLink + "/src"
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", srcLink, nil)
+const bitbucketPageLength = 100
+
+type bitbucketRepositoriesPage struct {
+	Size    int                          `json:"size"`
+	Pagelen int                          `json:"pagelen"`
+	Next    string                       `json:"next"`
+	Values  []BitbucketRepositoryListing `json:"values"`
+}
+
+// BitbucketLink is a link in the `links` of a bitbucket api object. Name is
+// only set for clone links.
+type BitbucketLink struct {
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+type BitbucketRepositoryLinks struct {
+	Self  BitbucketLink   `json:"self"`
+	Html  BitbucketLink   `json:"html"`
+	Clone []BitbucketLink `json:"clone"`
+}
+
+// ParseBitbucketRepositoryLinks maps the untyped links of a bitbucket.Repository
+func ParseBitbucketRepositoryLinks(repository bitbucket.Repository) (BitbucketRepositoryLinks, error) {
+	var links BitbucketRepositoryLinks
+	data, err := json.Marshal(repository.Links)
 	if err != nil {
-		return "", err
+		return links, err
 	}
-	req.SetBasicAuth(b.username, b.password)
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+	if err := json.Unmarshal(data, &links); err != nil {
+		return links, fmt.Errorf("unexpected links of repository %s: %v", repository.Full_name, err)
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Fatalf("Could not close response body: %v", err)
-		}
-	}()
-	// Ok, I'll admit its not golangs fault from here on ;)
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		} else {
-			var jsonMap map[string]interface{}
-			err := json.Unmarshal(bodyBytes, &jsonMap)
+	return links, nil
+}
 
-			if err != nil {
-				log.Fatalf("Cannot parse bitbucket api response.")
+// BitbucketRepositoryListing adds the fields we need to bitbucket.Repository
+type BitbucketRepositoryListing struct {
+	bitbucket.Repository
+	UpdatedOn string `json:"updated_on"`
+}
+
+// listWorkspaceRepositories follows the pagination of the repositories of a
+// workspace to the end. It also returns the total number of repositories as
+// reported by bitbucket.
+func (b *BitbucketModule) listWorkspaceRepositories(workspace string) ([]BitbucketRepositoryListing, int, error) {
+	pageUrl := fmt.Sprintf("%s/repositories/%s?pagelen=%d", b.apiUrl, url.PathEscape(workspace), bitbucketPageLength)
+	var repositories []BitbucketRepositoryListing
+	total := 0
+	for page := 1; pageUrl != ""; page++ {
+		var response bitbucketRepositoriesPage
+		if _, err := b.api.GetJson(pageUrl, &response); err != nil {
+			return nil, 0, err
+		}
+		if page == 1 {
+			total = response.Size
+			if response.Pagelen < bitbucketPageLength {
+				fmt.Printf("  ! Bitbucket capped the page size for %s to %d\n", workspace, response.Pagelen)
 			}
-			iter := reflect.ValueOf(jsonMap).MapRange()
-			for iter.Next() {
-				key := iter.Key()
-				if key.String() == "values" {
-					values := iter.Value()
-					kind := values.Kind()
-					if kind == reflect.Interface {
-						items := values.Interface().([]interface{})
-						for i := 0; i < len(items); i++ {
-							item := items[i]
-							file := item.(map[string]interface{})
-							path := file["path"].(string)
-							if strings.EqualFold(path, "README.md") {
-								iter := reflect.ValueOf(file["links"]).MapRange()
-								var selfLink interface{}
-								for iter.Next() {
-									selfLink = iter.Value().Interface().(map[string]interface{})
-									readmeLink := selfLink.(map[string]interface{})["href"].(string)
-									req, err := http.NewRequest("GET", readmeLink, nil)
-									if err != nil {
-										return "", err
-									}
-									req.SetBasicAuth(b.username, b.password)
-									resp, err := client.Do(req)
-									if err != nil {
-										return "", err
-									}
-									defer func() {
-										if err := resp.Body.Close(); err != nil {
-											log.Fatalf("Could not close response body: %v", err)
-										}
-									}()
-									if resp.StatusCode == http.StatusOK {
-										bodyBytes, err := ioutil.ReadAll(resp.Body)
-										if err != nil {
-											return "", err
-										} else {
-											return string(bodyBytes), nil
-										}
-									} else {
-										return "", fmt.Errorf("could not get README. Status: %v", resp.StatusCode)
-									}
-								}
-							}
-						}
-					}
-				}
+		}
+		repositories = append(repositories, response.Values...)
+		pageUrl = response.Next
+	}
+	return repositories, total, nil
+}
+
+type bitbucketSrcPage struct {
+	Next   string `json:"next"`
+	Values []struct {
+		Path string `json:"path"`
+		// commit_file or commit_directory
+		Type string `json:"type"`
+	} `json:"values"`
+}
+
+// GetReadmeText lists the src of the main branch page by page, because
+// bitbucket has no endpoint for the README.
+func (b *BitbucketModule) GetReadmeText(repository HostedRepository) (string, error) {
+	srcUrl := fmt.Sprintf("%s/repositories/%s/src/", b.apiUrl, repository.FullName)
+	if repository.DefaultBranch != "" {
+		srcUrl += url.PathEscape(repository.DefaultBranch) + "/"
+	}
+	var fileNames []string
+	for pageUrl := srcUrl + "?pagelen=100"; pageUrl != ""; {
+		var page bitbucketSrcPage
+		if _, err := b.api.GetJson(pageUrl, &page); err != nil {
+			return "", err
+		}
+		for _, file := range page.Values {
+			if file.Type == "commit_file" {
+				fileNames = append(fileNames, file.Path)
 			}
 		}
-	} else {
-		return "", fmt.Errorf("could not get README. Status: %v", resp.StatusCode)
+		pageUrl = page.Next
+	}
+	readme := selectReadme(fileNames)
+	if readme == "" {
+		return "", nil
 	}
-	return "", nil
+	response, err := b.api.Get(srcUrl+url.PathEscape(readme), readmeDownloadLimit(b.readmeMaxSize))
+	if err != nil {
+		return "", err
+	}
+	return cleanReadme(string(response.Body), b.readmeMaxSize), nil
 }
 
 func (b *BitbucketModule) UpdateExternalData() {
-	allRepositories := b.LoadRepositories()
-	fmt.Printf("  - Analyzing %d repositories\n", len(allRepositories))
-	updatedReposList := b.LoadReadmes(allRepositories)
-	var newRepos []BitbucketRepositoryWithReadme
-	for _, repo := range updatedReposList {
-		slug := repo.Repository.Slug
-		found := false
-		for _, previewsRepo := range b.repositoriesWithReadme {
-			if slug == previewsRepo.Repository.Slug {
-				found = true
-				break
-			}
-			if found {
-				break
+	hostedRepositories := IndexRepositories(b)
+	repositories := make([]BitbucketRepositoryWithReadme, len(hostedRepositories))
+	forEachConcurrently(len(hostedRepositories), func(i int) {
+		repo := BitbucketRepositoryWithReadme{HostedRepository: hostedRepositories[i]}
+		if b.pipelines {
+			pipelines, err := b.LoadLatestPipelines(repo.FullName)
+			if err != nil {
+				fmt.Printf("  ! Cannot get pipelines for %s: %v\n", repo.FullName, err)
 			}
+			repo.Pipelines = pipelines
 		}
-		if !found {
-			newRepos = append(newRepos, repo)
+		if b.refs {
+			b.UpdateRefs(&repo)
 		}
-	}
+		repositories[i] = repo
+	})
+	newRepos := NewRepositories(b.HostedRepositories(), hostedRepositories)
 	if len(newRepos) > 0 {
-		b.notificationModule.AddNotification(prepareBitbucketNotification(newRepos))
+		b.notificationModule.AddNotification(RepositoryNotification("New bitbucket repositories found", "https://raw.githubusercontent.com/sne11ius/furbnicator/main/bitbucket-logo.jpeg", newRepos))
 	}
-	b.repositoriesWithReadme = updatedReposList
+	b.repositoriesWithReadme = repositories
 }
 
-func prepareBitbucketNotification(createdRepos []BitbucketRepositoryWithReadme) Notification {
-	text := ""
-	for _, repo := range createdRepos {
-		iter := reflect.ValueOf(repo.Repository.Links["html"]).MapRange()
-		var htmlLink string
-		for iter.Next() {
-			htmlLink = iter.Value().Interface().(string)
-			break
-		}
-		text = text + "- [" + repo.Repository.Name + "](" + htmlLink + ")\\n"
-	}
-	return Notification{
-		Title:   "New bitbucket repositories found",
-		Text:    text,
-		IconUrl: "https://raw.githubusercontent.com/sne11ius/furbnicator/main/bitbucket-logo.jpeg",
+func (b *BitbucketModule) HostedRepositories() []HostedRepository {
+	var repositories []HostedRepository
+	for _, repo := range b.repositoriesWithReadme {
+		repositories = append(repositories, repo.HostedRepository)
 	}
+	return repositories
 }
 
 func (b *BitbucketModule) WriteExternalData(file *os.File) {
-	bytes, err := json.Marshal(b.repositoriesWithReadme)
-	if err != nil {
-		log.Fatalf("Cannot serialize repository data: %s", err)
-	}
-	if _, err = file.Write(bytes); err != nil {
-		log.Fatalf("Cannot write repository data to %v: %s", file, err)
-	}
+	writeRepositoryCache(file, b.repositoriesWithReadme)
 }
 
 func (b *BitbucketModule) ReadExternalData(data []byte) error {
-	err := json.Unmarshal(data, &b.repositoriesWithReadme)
+	err := readRepositoryCache(data, &b.repositoriesWithReadme, func() []string {
+		var fullNames []string
+		for _, repo := range b.repositoriesWithReadme {
+			fullNames = append(fullNames, repo.FullName)
+		}
+		return fullNames
+	})
 	if err != nil {
-		return err //log.Fatalf("Cannot read bitbucket project cache. Consider running with `-u` parameter.")
+		b.readLegacyRepositoryCache(data)
 	}
-	return nil
-}
-
-type BitbucketBrowseAction struct {
-	repo BitbucketRepositoryWithReadme
+	return err
 }
 
-func (b BitbucketBrowseAction) GetLabel() string {
-	return "[bitbucket[] BROWSE " + b.repo.Repository.Name
+// bitbucketLegacyCacheEntry is a repository as cached by older versions
+type bitbucketLegacyCacheEntry struct {
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Readme string `json:"readme"`
 }
 
-func (b BitbucketBrowseAction) Run() string {
-	url := b.repo.Repository.Links["html"].(map[string]interface{})["href"].(string)
-	if err := launchUrl(url); err != nil {
-		log.Fatalf("Could not browse %s: %v", url, err)
+// readLegacyRepositoryCache keeps the names of the repositories of an older
+// cache, so the next update does not report all of them as new
+func (b *BitbucketModule) readLegacyRepositoryCache(data []byte) {
+	var entries []bitbucketLegacyCacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return
 	}
-	return "Opened " + url
-}
-
-type BitbucketCloneAction struct {
-	repo BitbucketRepositoryWithReadme
-}
-
-func (b BitbucketCloneAction) GetLabel() string {
-	return "[bitbucket[] CLONE " + b.repo.Repository.Name
-}
-
-func (b BitbucketCloneAction) Run() string {
-	var cloneUrl string
-	found := false
-	cloneLinks := b.repo.Repository.Links["clone"].([]interface{})
-	for _, link := range cloneLinks {
-		linkMap := link.(map[string]interface{})
-		name := linkMap["name"].(string)
-		if name == "ssh" {
-			cloneUrl = linkMap["href"].(string)
-			found = true
-			break
+	b.repositoriesWithReadme = nil
+	for _, entry := range entries {
+		if entry.Repository.FullName != "" {
+			b.repositoriesWithReadme = append(b.repositoriesWithReadme, BitbucketRepositoryWithReadme{HostedRepository: HostedRepository{
+				Name:     entry.Repository.Name,
+				FullName: entry.Repository.FullName,
+				Readme:   entry.Readme,
+			}})
 		}
 	}
-	if !found {
-		log.Fatalf("No ssh clone link found for repo %s", b.repo.Repository.Name)
-	}
-	if err := runGitClone(cloneUrl); err != nil {
-		log.Fatalf("Could not clone %s: %v", cloneUrl, err)
-	}
-	return "Cloned " + cloneUrl
 }
 
 func (b *BitbucketModule) CreateActions(tags []Tag) []action {
 	var actions []action
+	searchesRefs := hasRefTag(tags)
 	for _, repo := range b.repositoriesWithReadme {
-		strs := []string{"bitbucket", "browse", repo.Repository.Name, repo.Readme, repo.Repository.Project.Name}
-		if DoMatch(strs, tags) {
-			actions = append(actions, BitbucketBrowseAction{repo: repo})
-		}
-		strs = []string{"bitbucket", "clone", repo.Repository.Name, repo.Readme, repo.Repository.Project.Name}
-		if DoMatch(strs, tags) {
-			actions = append(actions, BitbucketCloneAction{repo: repo})
+		var refStrs []string
+		if searchesRefs {
+			refStrs = repo.Refs.searchStrings()
+			actions = append(actions, b.createRefActions(repo, tags)...)
 		}
+		actions = append(actions, CreateRepositoryActions(b, repo.HostedRepository, tags, refStrs)...)
+		actions = append(actions, b.createPipelineActions(repo, tags)...)
 	}
 	return actions
 }
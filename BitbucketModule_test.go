@@ -0,0 +1,226 @@
+package main
+
+import (
+	"github.com/ktrysmt/go-bitbucket"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordedBitbucketApiUrl is replaced by the url of the test server in the
+// recorded responses
+const recordedBitbucketApiUrl = "https://api.bitbucket.org/2.0"
+
+// newBitbucketTestServer serves the recorded responses in testdata/bitbucket.
+// fixtures maps the request uri to the fixture file.
+func newBitbucketTestServer(t *testing.T, fixtures map[string]string) (*httptest.Server, *BitbucketModule) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "jdoe" || password != "app-password" {
+			t.Errorf("%s: missing basic auth", r.URL)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fixture, ok := fixtures[r.URL.RequestURI()]
+		if !ok {
+			t.Errorf("unexpected request %s", r.URL.RequestURI())
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "bitbucket", fixture))
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body := strings.ReplaceAll(string(data), recordedBitbucketApiUrl, server.URL+"/2.0")
+		if strings.HasSuffix(fixture, ".json") {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	module := &BitbucketModule{
+		apiUrl:        server.URL + "/2.0",
+		username:      "jdoe",
+		password:      "app-password",
+		api:           NewApiClient("Bitbucket", BasicAuth("jdoe", "app-password")),
+		readmeMaxSize: defaultReadmeMaxSize,
+	}
+	return server, module
+}
+
+func TestParseBitbucketRepositoryLinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		links   map[string]interface{}
+		want    BitbucketRepositoryLinks
+		wantErr bool
+	}{
+		{
+			name: "all links",
+			links: map[string]interface{}{
+				"html": map[string]interface{}{"href": "https://bitbucket.org/acme/app"},
+				"clone": []interface{}{
+					map[string]interface{}{"name": "ssh", "href": "git@bitbucket.org:acme/app.git"},
+				},
+			},
+			want: BitbucketRepositoryLinks{
+				Html:  BitbucketLink{Href: "https://bitbucket.org/acme/app"},
+				Clone: []BitbucketLink{{Name: "ssh", Href: "git@bitbucket.org:acme/app.git"}},
+			},
+		},
+		{
+			name:  "no links",
+			links: nil,
+		},
+		{
+			name:  "missing clone links",
+			links: map[string]interface{}{"html": map[string]interface{}{"href": "https://bitbucket.org/acme/app"}},
+			want:  BitbucketRepositoryLinks{Html: BitbucketLink{Href: "https://bitbucket.org/acme/app"}},
+		},
+		{
+			name:    "html link is a string",
+			links:   map[string]interface{}{"html": "https://bitbucket.org/acme/app"},
+			wantErr: true,
+		},
+		{
+			name:    "clone links are no list",
+			links:   map[string]interface{}{"clone": map[string]interface{}{"href": "git@bitbucket.org:acme/app.git"}},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseBitbucketRepositoryLinks(bitbucket.Repository{Full_name: "acme/app", Links: test.links})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseBitbucketRepositoryLinks() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseBitbucketRepositoryLinks() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBitbucketListRepositories(t *testing.T) {
+	server, module := newBitbucketTestServer(t, map[string]string{
+		"/2.0/workspaces":                           "workspaces.json",
+		"/2.0/repositories/acme?pagelen=100":        "repositories-acme-1.json",
+		"/2.0/repositories/acme?pagelen=100&page=2": "repositories-acme-2.json",
+	})
+	defer server.Close()
+
+	repositories, err := module.ListRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HostedRepository{
+		{
+			Name:          "Payment Service",
+			FullName:      "acme/payment-service",
+			Project:       "Payments",
+			ProjectKey:    "PAY",
+			Slug:          "payment-service",
+			DefaultBranch: "develop",
+			WebUrl:        "https://bitbucket.org/acme/payment-service",
+			CloneLinks: []CloneLink{
+				{Name: "https", Href: "https://jdoe@bitbucket.org/acme/payment-service.git"},
+				{Name: "ssh", Href: "git@bitbucket.org:acme/payment-service.git"},
+			},
+			Host:      "bitbucket.org",
+			Workspace: "acme",
+			UpdatedOn: "2020-12-01T09:15:42.123456+00:00",
+		},
+		{
+			// The html link has the wrong shape, so all links are built from
+			// the full name
+			Name:          "legacy-batch",
+			FullName:      "acme/legacy-batch",
+			Project:       "Operations",
+			ProjectKey:    "OPS",
+			Slug:          "legacy-batch",
+			DefaultBranch: "master",
+			WebUrl:        "https://bitbucket.org/acme/legacy-batch",
+			CloneLinks:    bitbucketCloudCloneLinks("acme/legacy-batch"),
+			Host:          "bitbucket.org",
+			Workspace:     "acme",
+			UpdatedOn:     "2019-03-11T16:02:10.000000+00:00",
+		},
+		{
+			// No links and no main branch
+			Name:       "infrastructure",
+			FullName:   "acme/infrastructure",
+			Project:    "Operations",
+			ProjectKey: "OPS",
+			Slug:       "infrastructure",
+			WebUrl:     "https://bitbucket.org/acme/infrastructure",
+			CloneLinks: bitbucketCloudCloneLinks("acme/infrastructure"),
+			Host:       "bitbucket.org",
+			Workspace:  "acme",
+			UpdatedOn:  "2020-11-30T08:00:00.000000+00:00",
+		},
+	}
+	if !reflect.DeepEqual(repositories, want) {
+		t.Errorf("ListRepositories() = %+v, want %+v", repositories, want)
+	}
+}
+
+func TestBitbucketGetReadmeText(t *testing.T) {
+	server, module := newBitbucketTestServer(t, map[string]string{
+		"/2.0/repositories/acme/payment-service/src/develop/?pagelen=100":        "src-payment-service-1.json",
+		"/2.0/repositories/acme/payment-service/src/develop/?pagelen=100&page=2": "src-payment-service-2.json",
+		"/2.0/repositories/acme/payment-service/src/develop/README.md":           "README-payment-service.md",
+	})
+	defer server.Close()
+
+	readme, err := module.GetReadmeText(HostedRepository{FullName: "acme/payment-service", DefaultBranch: "develop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Build\n\n# Payment Service\n\nBooks SEPA transfers. See the runbook for\non-call details."
+	if readme != want {
+		t.Errorf("GetReadmeText() = %q, want %q", readme, want)
+	}
+}
+
+func TestBitbucketGetReadmeTextWithoutReadme(t *testing.T) {
+	// The repository has no main branch, so the src of the latest commit is
+	// listed. A directory named readme is no README.
+	server, module := newBitbucketTestServer(t, map[string]string{
+		"/2.0/repositories/acme/infrastructure/src/?pagelen=100": "src-infrastructure.json",
+	})
+	defer server.Close()
+
+	readme, err := module.GetReadmeText(HostedRepository{FullName: "acme/infrastructure"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readme != "" {
+		t.Errorf("GetReadmeText() = %q, want no README", readme)
+	}
+}
+
+func TestBitbucketReadLegacyExternalData(t *testing.T) {
+	legacy := `[{"repository":{"name":"Payment Service","full_name":"acme/payment-service","slug":"payment-service"},"readme":"Books SEPA transfers"}]`
+	module := &BitbucketModule{}
+	if err := module.ReadExternalData([]byte(legacy)); err == nil {
+		t.Errorf("ReadExternalData() of a legacy cache should ask for an update")
+	}
+	want := []HostedRepository{{Name: "Payment Service", FullName: "acme/payment-service", Readme: "Books SEPA transfers"}}
+	if !reflect.DeepEqual(module.HostedRepositories(), want) {
+		t.Errorf("HostedRepositories() = %+v, want %+v", module.HostedRepositories(), want)
+	}
+
+	current := []HostedRepository{{FullName: "acme/payment-service"}, {FullName: "acme/infrastructure"}}
+	newRepos := NewRepositories(module.HostedRepositories(), current)
+	if len(newRepos) != 1 || newRepos[0].FullName != "acme/infrastructure" {
+		t.Errorf("NewRepositories() = %+v, want only acme/infrastructure", newRepos)
+	}
+	if newRepos := NewRepositories(nil, current); newRepos != nil {
+		t.Errorf("NewRepositories() without previous repositories = %+v, want none", newRepos)
+	}
+}
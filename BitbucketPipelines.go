@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type BitbucketPipeline struct {
+	Uuid        string `json:"uuid"`
+	BuildNumber int    `json:"build_number"`
+	CreatedOn   string `json:"created_on"`
+	State       struct {
+		Name   string `json:"name"`
+		Result struct {
+			Name string `json:"name"`
+		} `json:"result"`
+	} `json:"state"`
+	Target struct {
+		RefType string `json:"ref_type"`
+		RefName string `json:"ref_name"`
+	} `json:"target"`
+}
+
+type bitbucketPipelinesPage struct {
+	Values []BitbucketPipeline `json:"values"`
+}
+
+type bitbucketPipelineVariable struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Status is the result of a completed pipeline or the state of a running one
+func (p BitbucketPipeline) Status() string {
+	if p.State.Result.Name != "" {
+		return p.State.Result.Name
+	}
+	return p.State.Name
+}
+
+func (p BitbucketPipeline) isRunning() bool {
+	return p.State.Name == "PENDING" || p.State.Name == "IN_PROGRESS"
+}
+
+func (b *BitbucketModule) loadPipelines(fullName string, pagelen int) ([]BitbucketPipeline, error) {
+	pipelinesUrl := fmt.Sprintf("%s/repositories/%s/pipelines/?sort=-created_on&pagelen=%d", b.apiUrl, fullName, pagelen)
+	var page bitbucketPipelinesPage
+	if _, err := b.api.GetJson(pipelinesUrl, &page); err != nil {
+		return nil, err
+	}
+	return page.Values, nil
+}
+
+// LoadLatestPipelines returns the latest pipeline for each branch that had a
+// pipeline recently.
+func (b *BitbucketModule) LoadLatestPipelines(fullName string) ([]BitbucketPipeline, error) {
+	pipelines, err := b.loadPipelines(fullName, 100)
+	if err != nil {
+		return nil, err
+	}
+	var latest []BitbucketPipeline
+	seen := map[string]bool{}
+	for _, pipeline := range pipelines {
+		ref := pipeline.Target.RefName
+		if ref == "" || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		latest = append(latest, pipeline)
+	}
+	return latest, nil
+}
+
+// createPipelineActions offers the cached pipelines for browsing. Triggering
+// and stopping ask bitbucket, so they are offered for repositories without
+// cached pipelines, too, but only if pipelines are enabled.
+func (b *BitbucketModule) createPipelineActions(repo BitbucketRepositoryWithReadme, tags []Tag) []action {
+	var actions []action
+	if !b.pipelines {
+		return actions
+	}
+	for _, pipeline := range repo.Pipelines {
+		strs := []string{"bitbucket", "pipeline", "browse", repo.Name, repo.Project, pipeline.Target.RefName, pipeline.Status()}
+		if DoMatch(strs, tags) {
+			actions = append(actions, BitbucketPipelineBrowseAction{repo: repo, pipeline: pipeline})
+		}
+	}
+	strs := []string{"bitbucket", "pipeline", "trigger", "run", repo.Name, repo.Project}
+	if DoMatch(strs, tags) {
+		actions = append(actions, BitbucketPipelineTriggerAction{repo: repo, bitbucketModule: b})
+	}
+	strs = []string{"bitbucket", "pipeline", "stop", repo.Name, repo.Project}
+	if DoMatch(strs, tags) {
+		actions = append(actions, BitbucketPipelineStopAction{repo: repo, bitbucketModule: b})
+	}
+	return actions
+}
+
+func bitbucketPipelineUrl(repo BitbucketRepositoryWithReadme, pipeline BitbucketPipeline) string {
+	return repo.WebUrl + "/pipelines/results/" + strconv.Itoa(pipeline.BuildNumber)
+}
+
+type BitbucketPipelineBrowseAction struct {
+	repo     BitbucketRepositoryWithReadme
+	pipeline BitbucketPipeline
+}
+
+func (b BitbucketPipelineBrowseAction) GetLabel() string {
+	return fmt.Sprintf("[bitbucket[] PIPELINE %s %s #%d %s", b.repo.Name, b.pipeline.Target.RefName, b.pipeline.BuildNumber, b.pipeline.Status())
+}
+
+func (b BitbucketPipelineBrowseAction) Run() string {
+	url := bitbucketPipelineUrl(b.repo, b.pipeline)
+	if err := launchUrl(url); err != nil {
+		log.Fatalf("Could not browse %s: %v", url, err)
+	}
+	return "Opened " + url
+}
+
+type BitbucketPipelineTriggerAction struct {
+	repo            BitbucketRepositoryWithReadme
+	bitbucketModule *BitbucketModule
+}
+
+func (b BitbucketPipelineTriggerAction) GetLabel() string {
+	return "[bitbucket[] TRIGGER-PIPELINE " + b.repo.Name
+}
+
+// Run asks for the branch, the name of the custom pipeline and its variables
+// and starts the pipeline.
+func (b BitbucketPipelineTriggerAction) Run() string {
+	branch := prompt("Branch:", b.repo.DefaultBranch)
+	pattern := prompt("Custom pipeline (empty for the default pipeline of the branch):", "")
+	variables := []bitbucketPipelineVariable{}
+	for {
+		variable := prompt("Variable as KEY=VALUE (empty to start the pipeline):", "")
+		if variable == "" {
+			break
+		}
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 {
+			fmt.Println("Please use KEY=VALUE")
+			continue
+		}
+		variables = append(variables, bitbucketPipelineVariable{Key: parts[0], Value: parts[1]})
+	}
+	target := map[string]interface{}{
+		"type":     "pipeline_ref_target",
+		"ref_type": "branch",
+		"ref_name": branch,
+	}
+	if pattern != "" {
+		target["selector"] = map[string]string{
+			"type":    "custom",
+			"pattern": pattern,
+		}
+	}
+	body := map[string]interface{}{
+		"target":    target,
+		"variables": variables,
+	}
+	fullName := b.repo.FullName
+	triggerUrl := fmt.Sprintf("%s/repositories/%s/pipelines/", b.bitbucketModule.apiUrl, fullName)
+	var pipeline BitbucketPipeline
+	if err := b.bitbucketModule.api.SendJson("POST", triggerUrl, body, &pipeline); err != nil {
+		log.Fatalf("Could not trigger pipeline for %s: %v", fullName, err)
+	}
+	return fmt.Sprintf("Started pipeline #%d: %s", pipeline.BuildNumber, bitbucketPipelineUrl(b.repo, pipeline))
+}
+
+type BitbucketPipelineStopAction struct {
+	repo            BitbucketRepositoryWithReadme
+	bitbucketModule *BitbucketModule
+}
+
+func (b BitbucketPipelineStopAction) GetLabel() string {
+	return "[bitbucket[] STOP-PIPELINE " + b.repo.Name
+}
+
+// Run looks for running pipelines and stops them after confirmation. The
+// cached pipelines are most likely outdated, so we ask bitbucket.
+func (b BitbucketPipelineStopAction) Run() string {
+	fullName := b.repo.FullName
+	pipelines, err := b.bitbucketModule.loadPipelines(fullName, 50)
+	if err != nil {
+		log.Fatalf("Could not get pipelines for %s: %v", fullName, err)
+	}
+	stopped := 0
+	for _, pipeline := range pipelines {
+		if !pipeline.isRunning() {
+			continue
+		}
+		if !confirm(fmt.Sprintf("Stop pipeline #%d on %s?", pipeline.BuildNumber, pipeline.Target.RefName)) {
+			continue
+		}
+		stopUrl := fmt.Sprintf("%s/repositories/%s/pipelines/%s/stopPipeline", b.bitbucketModule.apiUrl, fullName, url.PathEscape(pipeline.Uuid))
+		if err := b.bitbucketModule.api.SendJson("POST", stopUrl, nil, nil); err != nil {
+			log.Fatalf("Could not stop pipeline #%d: %v", pipeline.BuildNumber, err)
+		}
+		stopped++
+	}
+	return fmt.Sprintf("Stopped %d pipelines of %s", stopped, b.repo.Name)
+}
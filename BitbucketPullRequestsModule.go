@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// BitbucketPullRequestsModule indexes the open pull requests of all
+// repositories known to the bitbucket module. It uses the credentials of the
+// bitbucket module.
+type BitbucketPullRequestsModule struct {
+	bitbucketModule *BitbucketModule
+	data            BitbucketPullRequestsData
+}
+
+type BitbucketPullRequestsData struct {
+	// AccountId of the configured user
+	AccountId    string                 `json:"accountId"`
+	PullRequests []BitbucketPullRequest `json:"pullRequests"`
+}
+
+type BitbucketAccount struct {
+	AccountId   string `json:"account_id"`
+	DisplayName string `json:"display_name"`
+	Nickname    string `json:"nickname"`
+}
+
+type BitbucketParticipant struct {
+	User     BitbucketAccount `json:"user"`
+	Role     string           `json:"role"`
+	Approved bool             `json:"approved"`
+}
+
+type BitbucketPullRequestEndpoint struct {
+	Branch struct {
+		Name string `json:"name"`
+	} `json:"branch"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+type BitbucketPullRequest struct {
+	Id           int                          `json:"id"`
+	Title        string                       `json:"title"`
+	State        string                       `json:"state"`
+	Author       BitbucketAccount             `json:"author"`
+	Reviewers    []BitbucketAccount           `json:"reviewers"`
+	Participants []BitbucketParticipant       `json:"participants"`
+	Source       BitbucketPullRequestEndpoint `json:"source"`
+	Destination  BitbucketPullRequestEndpoint `json:"destination"`
+	Links        struct {
+		Html struct {
+			Href string `json:"href"`
+		} `json:"html"`
+	} `json:"links"`
+	// ProjectKey of the destination repository. Not part of the api response.
+	ProjectKey string `json:"projectKey"`
+}
+
+type bitbucketPullRequestsPage struct {
+	Next   string                 `json:"next"`
+	Values []BitbucketPullRequest `json:"values"`
+}
+
+func NewBitbucketPullRequestsModule(bitbucketModule *BitbucketModule) *BitbucketPullRequestsModule {
+	p := new(BitbucketPullRequestsModule)
+	p.bitbucketModule = bitbucketModule
+	return p
+}
+
+func (p *BitbucketPullRequestsModule) Name() string {
+	return "BitbucketPullRequests"
+}
+
+func (p *BitbucketPullRequestsModule) Description() string {
+	return "Provides access to open bitbucket pull requests"
+}
+
+func (p *BitbucketPullRequestsModule) CanBeDisabled() bool {
+	return true
+}
+
+func (p *BitbucketPullRequestsModule) UpdateSettings() {
+	// We need the credentials even if the bitbucket module is not active
+	p.bitbucketModule.UpdateSettings()
+}
+
+func (p *BitbucketPullRequestsModule) NeedsExternalData() bool {
+	return true
+}
+
+func (p *BitbucketPullRequestsModule) UpdateExternalData() {
+	b := p.bitbucketModule
+	var user BitbucketAccount
+	if _, err := b.api.GetJson(b.apiUrl+"/user", &user); err != nil {
+		log.Fatalf("Cannot get bitbucket user: %v", err)
+	}
+
+	repositories := b.HostedRepositories()
+	if len(repositories) == 0 {
+		var err error
+		if repositories, err = b.ListRepositories(); err != nil {
+			log.Fatalf("Cannot list bitbucket repositories: %v", err)
+		}
+	}
+
+	pullRequestsPerRepository := make([][]BitbucketPullRequest, len(repositories))
+	forEachConcurrently(len(repositories), func(i int) {
+		pullRequests, err := p.LoadPullRequests(repositories[i])
+		if err != nil {
+			log.Fatalf("Cannot get pull requests for %s: %v", repositories[i].FullName, err)
+		}
+		pullRequestsPerRepository[i] = pullRequests
+	})
+	var allPullRequests []BitbucketPullRequest
+	for _, pullRequests := range pullRequestsPerRepository {
+		allPullRequests = append(allPullRequests, pullRequests...)
+	}
+
+	p.data = BitbucketPullRequestsData{
+		AccountId:    user.AccountId,
+		PullRequests: allPullRequests,
+	}
+	fmt.Printf("  - Updated %d pull requests\n", len(allPullRequests))
+}
+
+// LoadPullRequests loads the open pull requests of a repository including
+// reviewers and participants.
+func (p *BitbucketPullRequestsModule) LoadPullRequests(repository HostedRepository) ([]BitbucketPullRequest, error) {
+	b := p.bitbucketModule
+	pageUrl := fmt.Sprintf("%s/repositories/%s/pullrequests?state=OPEN&pagelen=50&fields=%s",
+		b.apiUrl, repository.FullName, url.QueryEscape("+values.reviewers,+values.participants"))
+	var pullRequests []BitbucketPullRequest
+	for pageUrl != "" {
+		var page bitbucketPullRequestsPage
+		if _, err := b.api.GetJson(pageUrl, &page); err != nil {
+			return nil, err
+		}
+		for _, pullRequest := range page.Values {
+			pullRequest.ProjectKey = repository.ProjectKey
+			pullRequests = append(pullRequests, pullRequest)
+		}
+		pageUrl = page.Next
+	}
+	return pullRequests, nil
+}
+
+func (p *BitbucketPullRequestsModule) WriteExternalData(file *os.File) {
+	bytes, err := json.Marshal(p.data)
+	if err != nil {
+		log.Fatalf("Cannot serialize pull request data: %s", err)
+	}
+	if _, err = file.Write(bytes); err != nil {
+		log.Fatalf("Cannot write pull request data to %v: %s", file, err)
+	}
+}
+
+func (p *BitbucketPullRequestsModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &p.data)
+}
+
+func (pr BitbucketPullRequest) isAuthor(accountId string) bool {
+	return accountId != "" && pr.Author.AccountId == accountId
+}
+
+// isReviewRequested is true if the user is a reviewer and did not approve yet
+func (pr BitbucketPullRequest) isReviewRequested(accountId string) bool {
+	if accountId == "" {
+		return false
+	}
+	for _, participant := range pr.Participants {
+		if participant.User.AccountId == accountId && participant.Approved {
+			return false
+		}
+	}
+	for _, reviewer := range pr.Reviewers {
+		if reviewer.AccountId == accountId {
+			return true
+		}
+	}
+	return false
+}
+
+func (pr BitbucketPullRequest) label(verb string) string {
+	return "[bitbucket-pr[] " + verb + " " + pr.Destination.Repository.Name + "#" + strconv.Itoa(pr.Id) + " " + pr.Title + " (" + pr.Author.DisplayName + ")"
+}
+
+type BitbucketPullRequestBrowseAction struct {
+	pullRequest BitbucketPullRequest
+}
+
+func (b BitbucketPullRequestBrowseAction) GetLabel() string {
+	return b.pullRequest.label("BROWSE")
+}
+
+func (b BitbucketPullRequestBrowseAction) Run() string {
+	url := b.pullRequest.Links.Html.Href
+	if err := launchUrl(url); err != nil {
+		log.Fatalf("Could not browse %s: %v", url, err)
+	}
+	return "Opened " + url
+}
+
+type BitbucketPullRequestApproveAction struct {
+	pullRequest     BitbucketPullRequest
+	bitbucketModule *BitbucketModule
+}
+
+func (b BitbucketPullRequestApproveAction) GetLabel() string {
+	return b.pullRequest.label("APPROVE")
+}
+
+func (b BitbucketPullRequestApproveAction) Run() string {
+	pr := b.pullRequest
+	approveUrl := fmt.Sprintf("%s/repositories/%s/pullrequests/%d/approve", b.bitbucketModule.apiUrl, pr.Destination.Repository.FullName, pr.Id)
+	if err := b.bitbucketModule.api.SendJson("POST", approveUrl, nil, nil); err != nil {
+		log.Fatalf("Could not approve pull request #%d: %v", pr.Id, err)
+	}
+	return fmt.Sprintf("Approved %s#%d %s", pr.Destination.Repository.Name, pr.Id, pr.Title)
+}
+
+type BitbucketPullRequestCheckoutAction struct {
+	pullRequest     BitbucketPullRequest
+	bitbucketModule *BitbucketModule
+}
+
+func (b BitbucketPullRequestCheckoutAction) GetLabel() string {
+	return b.pullRequest.label("CHECKOUT")
+}
+
+// Run checks out the source branch in the local clone of the destination
+// repository. If there is no local clone yet, we clone at the source branch.
+func (b BitbucketPullRequestCheckoutAction) Run() string {
+	pr := b.pullRequest
+	branch := pr.Source.Branch.Name
+	destination := pr.Destination.Repository.FullName
+	target := CloneTarget{
+		Host:             "bitbucket.org",
+		Workspace:        strings.Split(destination, "/")[0],
+		Project:          pr.ProjectKey,
+		Repo:             strings.Split(destination, "/")[1],
+		Branch:           branch,
+		CredentialHelper: b.bitbucketModule.cloneSettings.CredentialHelper,
+	}
+	var err error
+	target.Url, err = gitModule.SelectCloneUrl(bitbucketCloudCloneLinks(destination), b.bitbucketModule.cloneSettings)
+	if err != nil {
+		log.Fatalf("Cannot clone repo %s: %v", destination, err)
+	}
+	sourceUrl := ""
+	if pr.Source.Repository.FullName != destination {
+		// Pull request from a fork
+		sourceUrl, err = gitModule.SelectCloneUrl(bitbucketCloudCloneLinks(pr.Source.Repository.FullName), b.bitbucketModule.cloneSettings)
+		if err != nil {
+			log.Fatalf("Cannot fetch from %s: %v", pr.Source.Repository.FullName, err)
+		}
+	}
+	message, err := gitModule.Checkout(target, sourceUrl)
+	if err != nil {
+		log.Fatalf("Could not check out pull request #%d: %v", pr.Id, err)
+	}
+	return message
+}
+
+// bitbucketCloudCloneLinks builds the clone links of a repository from its full
+// name, eg. for repositories that we only know from a pull request.
+func bitbucketCloudCloneLinks(fullName string) []CloneLink {
+	return []CloneLink{
+		{Name: "ssh", Href: "git@bitbucket.org:" + fullName + ".git"},
+		{Name: "https", Href: "https://bitbucket.org/" + fullName + ".git"},
+	}
+}
+
+func (p *BitbucketPullRequestsModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	for _, pr := range p.data.PullRequests {
+		strs := []string{
+			"bitbucket", "pr", "pull-request", pr.State, pr.Title, pr.Destination.Repository.Name,
+			pr.Source.Branch.Name, pr.Destination.Branch.Name, pr.Author.DisplayName, pr.Author.Nickname,
+		}
+		for _, reviewer := range pr.Reviewers {
+			strs = append(strs, reviewer.DisplayName, reviewer.Nickname)
+		}
+		if pr.isAuthor(p.data.AccountId) {
+			strs = append(strs, "mine")
+		}
+		if pr.isReviewRequested(p.data.AccountId) {
+			strs = append(strs, "review-requested")
+		}
+		if DoMatch(append(strs, "browse"), tags) {
+			actions = append(actions, BitbucketPullRequestBrowseAction{pullRequest: pr})
+		}
+		if DoMatch(append(strs, "checkout"), tags) {
+			actions = append(actions, BitbucketPullRequestCheckoutAction{pullRequest: pr, bitbucketModule: p.bitbucketModule})
+		}
+		if !pr.isAuthor(p.data.AccountId) && DoMatch(append(strs, "approve"), tags) {
+			actions = append(actions, BitbucketPullRequestApproveAction{pullRequest: pr, bitbucketModule: p.bitbucketModule})
+		}
+	}
+	return actions
+}
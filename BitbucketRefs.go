@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// BitbucketRefs are the branch and tag names of a repository
+type BitbucketRefs struct {
+	Branches []string `json:"branches"`
+	Tags     []string `json:"tags"`
+}
+
+type bitbucketRefsPage struct {
+	Next   string `json:"next"`
+	Values []struct {
+		Name string `json:"name"`
+	} `json:"values"`
+}
+
+const (
+	branchTagPrefix = "branch:"
+	tagTagPrefix    = "tag:"
+)
+
+// UpdateRefs loads the branches and tags of the repository. If the repository
+// did not change since the last update, we keep the cached refs.
+func (b *BitbucketModule) UpdateRefs(repo *BitbucketRepositoryWithReadme) {
+	for _, previous := range b.repositoriesWithReadme {
+		if previous.FullName == repo.FullName {
+			if previous.Refs != nil && previous.UpdatedOn != "" && previous.UpdatedOn == repo.UpdatedOn {
+				repo.Refs = previous.Refs
+				return
+			}
+			break
+		}
+	}
+	branches, err := b.loadRefNames(repo.FullName, "branches")
+	if err != nil {
+		fmt.Printf("  ! Cannot get branches of %s: %v\n", repo.FullName, err)
+		return
+	}
+	tags, err := b.loadRefNames(repo.FullName, "tags")
+	if err != nil {
+		fmt.Printf("  ! Cannot get tags of %s: %v\n", repo.FullName, err)
+		return
+	}
+	repo.Refs = &BitbucketRefs{
+		Branches: branches,
+		Tags:     tags,
+	}
+}
+
+func (b *BitbucketModule) loadRefNames(fullName string, kind string) ([]string, error) {
+	pageUrl := fmt.Sprintf("%s/repositories/%s/refs/%s?pagelen=100&fields=next,values.name", b.apiUrl, fullName, kind)
+	var names []string
+	for pageUrl != "" {
+		var page bitbucketRefsPage
+		if _, err := b.api.GetJson(pageUrl, &page); err != nil {
+			return nil, err
+		}
+		for _, ref := range page.Values {
+			names = append(names, ref.Name)
+		}
+		pageUrl = page.Next
+	}
+	return names, nil
+}
+
+// hasRefTag is true if the user searches for branches or tags. We only include
+// refs in the search if asked to, because eg. every repository has a `main`
+// branch.
+func hasRefTag(tags []Tag) bool {
+	for _, tag := range tags {
+		value := strings.ToLower(tag.value)
+		if strings.HasPrefix(value, branchTagPrefix) || strings.HasPrefix(value, tagTagPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *BitbucketRefs) searchStrings() []string {
+	if r == nil {
+		return nil
+	}
+	var strs []string
+	for _, branch := range r.Branches {
+		strs = append(strs, branchTagPrefix+branch)
+	}
+	for _, tag := range r.Tags {
+		strs = append(strs, tagTagPrefix+tag)
+	}
+	return strs
+}
+
+func (b *BitbucketModule) createRefActions(repo BitbucketRepositoryWithReadme, tags []Tag) []action {
+	if repo.Refs == nil {
+		return nil
+	}
+	var actions []action
+	add := func(refType string, ref string) {
+		strs := []string{"bitbucket", repo.Name, repo.Project, refType + ":" + ref}
+		if DoMatch(append(strs, "browse"), tags) {
+			actions = append(actions, BitbucketRefBrowseAction{repo: repo, refType: refType, ref: ref})
+		}
+		if DoMatch(append(strs, "clone"), tags) {
+			actions = append(actions, BitbucketRefCloneAction{repo: repo, refType: refType, ref: ref, cloneSettings: b.cloneSettings})
+		}
+		if DoMatch(append(strs, "compare"), tags) {
+			actions = append(actions, BitbucketRefCompareAction{repo: repo, refType: refType, ref: ref})
+		}
+	}
+	for _, branch := range repo.Refs.Branches {
+		add("branch", branch)
+	}
+	for _, tag := range repo.Refs.Tags {
+		add("tag", tag)
+	}
+	return actions
+}
+
+func bitbucketRefLabel(verb string, repo BitbucketRepositoryWithReadme, refType string, ref string) string {
+	return "[bitbucket[] " + verb + " " + repo.Name + " " + refType + ":" + ref
+}
+
+type BitbucketRefBrowseAction struct {
+	repo    BitbucketRepositoryWithReadme
+	refType string
+	ref     string
+}
+
+func (b BitbucketRefBrowseAction) GetLabel() string {
+	return bitbucketRefLabel("BROWSE", b.repo, b.refType, b.ref)
+}
+
+func (b BitbucketRefBrowseAction) Run() string {
+	// Branch names like feature/x keep their slashes in the url
+	var segments []string
+	for _, segment := range strings.Split(b.ref, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	browseUrl := b.repo.WebUrl + "/src/" + strings.Join(segments, "/")
+	if err := launchUrl(browseUrl); err != nil {
+		log.Fatalf("Could not browse %s: %v", browseUrl, err)
+	}
+	return "Opened " + browseUrl
+}
+
+type BitbucketRefCloneAction struct {
+	repo          BitbucketRepositoryWithReadme
+	refType       string
+	ref           string
+	cloneSettings CloneSettings
+}
+
+func (b BitbucketRefCloneAction) GetLabel() string {
+	return bitbucketRefLabel("CLONE", b.repo, b.refType, b.ref)
+}
+
+func (b BitbucketRefCloneAction) Run() string {
+	target, err := b.repo.CloneTarget(b.cloneSettings, b.ref)
+	if err != nil {
+		log.Fatalf("Cannot clone repo %s: %v", b.repo.Name, err)
+	}
+	message, err := gitModule.Clone(target)
+	if err != nil {
+		log.Fatalf("Could not clone %s: %v", target.Url, err)
+	}
+	return message
+}
+
+type BitbucketRefCompareAction struct {
+	repo    BitbucketRepositoryWithReadme
+	refType string
+	ref     string
+}
+
+func (b BitbucketRefCompareAction) GetLabel() string {
+	return bitbucketRefLabel("COMPARE", b.repo, b.refType, b.ref) + " with " + b.repo.DefaultBranch
+}
+
+func (b BitbucketRefCompareAction) Run() string {
+	// Bitbucket separates source and destination of the comparison with a
+	// carriage return
+	compareUrl := b.repo.WebUrl + "/branches/compare/" +
+		url.PathEscape(b.ref) + "%0D" + url.PathEscape(b.repo.DefaultBranch)
+	if err := launchUrl(compareUrl); err != nil {
+		log.Fatalf("Could not browse %s: %v", compareUrl, err)
+	}
+	return "Opened " + compareUrl
+}
@@ -3,26 +3,23 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/sne11ius/bitclient"
 	"github.com/spf13/viper"
-	"io/ioutil"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"strings"
-	"sync"
 )
 
 type BitbucketServerModule struct {
-	httpUrl                string
-	username               string
-	password               string
-	repositoriesWithReadme []BitbucketServerRepositoryWithReadme
-}
-
-type BitbucketServerRepositoryWithReadme struct {
-	Repository bitclient.Repository `json:"repository"`
-	Readme     string               `json:"readme"`
+	httpUrl  string
+	username string
+	password string
+	// token is a http access token. If set, it is used instead of the password.
+	token         string
+	api           *ApiClient
+	cloneSettings CloneSettings
+	readmeMaxSize int
+	repositories  []HostedRepository
 }
 
 func NewBitbucketServerModule() *BitbucketServerModule {
@@ -54,198 +51,238 @@ func (b *BitbucketServerModule) UpdateSettings() {
 	}
 	b.username = viper.GetString(configKey)
 
+	b.token = viper.GetString(b.Name() + ".token")
 	configKey = b.Name() + ".password"
-	if !viper.IsSet(configKey) {
-		log.Fatalf("Missing configuration key `%s` (eg. 'mypassword')", configKey)
+	if b.token == "" && !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'mypassword') or `%s.token`", configKey, b.Name())
 	}
 	b.password = viper.GetString(configKey)
+	auth := BasicAuth(b.username, b.password)
+	if b.token != "" {
+		auth = BearerAuth(b.token)
+	}
+	b.api = NewApiClient(b.Name(), auth)
+
+	b.cloneSettings = ReadCloneSettings(b.Name(), "auto")
+	b.readmeMaxSize = readReadmeMaxSize(b.Name())
 }
 
 func (b *BitbucketServerModule) NeedsExternalData() bool {
 	return true
 }
 
-func (b *BitbucketServerModule) UpdateExternalData() {
-	allRepositories := b.LoadRepositories()
-	b.repositoriesWithReadme = b.LoadReadmes(allRepositories)
-	fmt.Printf("  - Updated %d projects\n", len(b.repositoriesWithReadme))
+func (b *BitbucketServerModule) Label() string {
+	return "[bitbucket-server[]"
 }
 
-func (b BitbucketServerModule) LoadRepositories() []bitclient.Repository {
-	client := bitclient.NewBitClient(b.httpUrl, b.username, b.password)
+func (b *BitbucketServerModule) Keywords() []string {
+	return []string{"bitbucket", "bitbucket-server"}
+}
 
-	requestParams := bitclient.PagedRequest{
-		Limit: 10000,
-		Start: 0,
-	}
-	projectsResponse, err := client.GetProjects(requestParams)
+func (b *BitbucketServerModule) CloneSettings() CloneSettings {
+	return b.cloneSettings
+}
 
-	if err != nil {
-		log.Fatalf("Cannot list projects: %v", err)
-	}
-
-	projects := projectsResponse.Values
-
-	numProjects := len(projects)
-	var wg sync.WaitGroup
-	wg.Add(numProjects)
-	queue := make(chan []bitclient.Repository, 1)
-	for i := 0; i < numProjects; i++ {
-		go func(i int) {
-			project := projects[i]
-			repositories, err := client.GetRepositories(project.Key, bitclient.PagedRequest{
-				Limit: 1000,
-				Start: 0,
-			})
-			if err != nil {
-				log.Fatalf("Cannot get repositories for %s", project.Name)
-			}
-			queue <- repositories.Values
-		}(i)
-	}
-	var allRepositories []bitclient.Repository
-	go func() {
-		for t := range queue {
-			allRepositories = append(allRepositories, t...)
-			wg.Done()
-		}
-	}()
-	wg.Wait()
-	return allRepositories
-}
-
-func (b *BitbucketServerModule) LoadReadmes(repositories []bitclient.Repository) []BitbucketServerRepositoryWithReadme {
-	numRepositories := len(repositories)
-	var wg sync.WaitGroup
-	wg.Add(numRepositories)
-	queue := make(chan BitbucketServerRepositoryWithReadme, 1)
-	for i := 0; i < numRepositories; i++ {
-		go func(i int) {
-			repository := repositories[i]
-			readme, err := b.GetReadmeText(repository, "develop")
-			if err != nil {
-				readme, _ = b.GetReadmeText(repository, "master")
-			}
-			queue <- BitbucketServerRepositoryWithReadme{
-				Repository: repository,
-				Readme:     readme,
-			}
-		}(i)
-	}
-	var repositoriesWithReadmes []BitbucketServerRepositoryWithReadme
-	go func() {
-		for t := range queue {
-			repositoriesWithReadmes = append(repositoriesWithReadmes, t)
-			wg.Done()
-		}
-	}()
-	wg.Wait()
-	return repositoriesWithReadmes
+func (b *BitbucketServerModule) UpdateExternalData() {
+	b.repositories = IndexRepositories(b)
+	fmt.Printf("  - Updated %d projects\n", len(b.repositories))
 }
 
-func (b *BitbucketServerModule) GetReadmeText(repository bitclient.Repository, branch string) (string, error) {
-	var selfLink = repository.Links["self"][0]["href"]
-	var baseLink = strings.TrimSuffix(selfLink, "/browse")
-	var readmeLink = baseLink + "/raw/README.md?at=refs%2Fheads%2F" + branch
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", readmeLink, nil)
+type bitbucketServerProject struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+}
+
+type bitbucketServerRepository struct {
+	Slug    string                 `json:"slug"`
+	Name    string                 `json:"name"`
+	Project bitbucketServerProject `json:"project"`
+	Links   struct {
+		Self  []BitbucketLink `json:"self"`
+		Clone []BitbucketLink `json:"clone"`
+	} `json:"links"`
+}
+
+func (b *BitbucketServerModule) ListRepositories() ([]HostedRepository, error) {
+	var projects []bitbucketServerProject
+	err := b.getPages("projects", b.restUrl("projects"), func(values json.RawMessage) (int, error) {
+		var page []bitbucketServerProject
+		err := json.Unmarshal(values, &page)
+		projects = append(projects, page...)
+		return len(page), err
+	})
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("cannot list projects: %v", err)
 	}
-	req.SetBasicAuth(b.username, b.password)
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+
+	var host string
+	if parsedUrl, err := url.Parse(b.httpUrl); err == nil {
+		host = parsedUrl.Hostname()
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Fatalf("Could not close response body: %v", err)
-		}
-	}()
-	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
+	repositoriesPerProject := make([][]HostedRepository, len(projects))
+	forEachConcurrently(len(projects), func(i int) {
+		project := projects[i]
+		var repositories []bitbucketServerRepository
+		err := b.getPages("repositories of "+project.Name, b.restUrl("projects", project.Key, "repos"), func(values json.RawMessage) (int, error) {
+			var page []bitbucketServerRepository
+			err := json.Unmarshal(values, &page)
+			repositories = append(repositories, page...)
+			return len(page), err
+		})
 		if err != nil {
-			return "", err
-		} else {
-			return string(bodyBytes), nil
+			log.Fatalf("Cannot get repositories for %s: %v", project.Name, err)
+		}
+		fmt.Printf("  - %d repositories in project %v\n", len(repositories), project.Name)
+		for _, repository := range repositories {
+			repositoriesPerProject[i] = append(repositoriesPerProject[i], hostedBitbucketServerRepository(host, repository))
 		}
-	} else {
-		return "", fmt.Errorf("could not get README. Status: %v", resp.StatusCode)
+	})
+	var allRepositories []HostedRepository
+	for _, repositories := range repositoriesPerProject {
+		allRepositories = append(allRepositories, repositories...)
 	}
+	return allRepositories, nil
 }
 
-func (b *BitbucketServerModule) WriteExternalData(file *os.File) {
-	bytes, err := json.Marshal(b.repositoriesWithReadme)
-	if err != nil {
-		log.Fatalf("Cannot serialize repository data: %s", err)
+// hostedBitbucketServerRepository maps a bitbucket server repository to the
+// shared model
+func hostedBitbucketServerRepository(host string, repository bitbucketServerRepository) HostedRepository {
+	repo := HostedRepository{
+		Name:       repository.Name,
+		FullName:   repository.Project.Key + "/" + repository.Slug,
+		Project:    repository.Project.Name,
+		ProjectKey: repository.Project.Key,
+		Slug:       repository.Slug,
+		Host:       host,
+		Workspace:  repository.Project.Key,
+	}
+	if len(repository.Links.Self) > 0 {
+		repo.WebUrl = repository.Links.Self[0].Href
 	}
-	if _, err = file.Write(bytes); err != nil {
-		log.Fatalf("Cannot write repository data to %v: %s", file, err)
+	for _, link := range repository.Links.Clone {
+		repo.CloneLinks = append(repo.CloneLinks, CloneLink{Name: link.Name, Href: link.Href})
 	}
+	return repo
 }
 
-func (b *BitbucketServerModule) ReadExternalData(data []byte) error {
-	err := json.Unmarshal(data, &b.repositoriesWithReadme)
-	if err != nil {
-		log.Fatalf("Cannot read bitbucket project cache. Please run with `-u` parameter first.")
+// restUrl builds an url of the rest api from escaped path segments
+func (b *BitbucketServerModule) restUrl(segments ...string) string {
+	restUrl := strings.TrimSuffix(b.httpUrl, "/") + "/rest/api/1.0"
+	for _, segment := range segments {
+		restUrl += "/" + url.PathEscape(segment)
 	}
-	return nil
+	return restUrl
 }
 
-type BitbucketServerBrowseAction struct {
-	repo BitbucketServerRepositoryWithReadme
-}
+const bitbucketServerPageLimit = 1000
 
-func (b BitbucketServerBrowseAction) GetLabel() string {
-	return "[bitbucket[] BROWSE " + b.repo.Repository.Name
+type bitbucketServerPage struct {
+	Limit         int             `json:"limit"`
+	IsLastPage    bool            `json:"isLastPage"`
+	NextPageStart int             `json:"nextPageStart"`
+	Values        json.RawMessage `json:"values"`
 }
 
-func (b BitbucketServerBrowseAction) Run() string {
-	url := b.repo.Repository.Links["self"][0]["href"]
-	if err := launchUrl(url); err != nil {
-		log.Fatalf("Could not browse %s: %v", url, err)
+// getPages requests the pages of a paged api url until bitbucket reports the
+// last page. addValues parses the values of a page and returns their number.
+func (b *BitbucketServerModule) getPages(what string, pagedUrl string, addValues func(values json.RawMessage) (int, error)) error {
+	separator := "?"
+	if strings.Contains(pagedUrl, "?") {
+		separator = "&"
+	}
+	start := 0
+	warned := false
+	for {
+		var page bitbucketServerPage
+		if _, err := b.api.GetJson(fmt.Sprintf("%s%slimit=%d&start=%d", pagedUrl, separator, bitbucketServerPageLimit, start), &page); err != nil {
+			return err
+		}
+		if !warned && page.Limit != 0 && page.Limit < bitbucketServerPageLimit {
+			fmt.Printf("  ! Bitbucket capped the page size for %s to %d\n", what, page.Limit)
+			warned = true
+		}
+		numValues, err := addValues(page.Values)
+		if err != nil {
+			return err
+		}
+		if page.IsLastPage || numValues == 0 {
+			return nil
+		}
+		start = page.NextPageStart
 	}
-	return "Opened " + url
 }
 
-type BitbucketServerCloneAction struct {
-	repo BitbucketServerRepositoryWithReadme
+type bitbucketServerBranch struct {
+	Id        string `json:"id"`
+	DisplayId string `json:"displayId"`
 }
 
-func (b BitbucketServerCloneAction) GetLabel() string {
-	return "[bitbucket[] CLONE " + b.repo.Repository.Name
+type bitbucketServerBrowsePage struct {
+	Children struct {
+		Values []struct {
+			Path struct {
+				Name string `json:"name"`
+			} `json:"path"`
+			// FILE or DIRECTORY
+			Type string `json:"type"`
+		} `json:"values"`
+	} `json:"children"`
 }
 
-func (b BitbucketServerCloneAction) Run() string {
-	var cloneUrl string
-	found := false
-	for _, link := range b.repo.Repository.Links["clone"] {
-		if strings.HasPrefix(link["href"], "ssh://") {
-			cloneUrl = link["href"]
-			found = true
-			break
+// GetReadmeText asks for the default branch first, since the repository
+// listing of bitbucket server does not include it.
+func (b *BitbucketServerModule) GetReadmeText(repository HostedRepository) (string, error) {
+	repositoryUrl := b.restUrl("projects", repository.ProjectKey, "repos", repository.Slug)
+	var defaultBranch bitbucketServerBranch
+	if _, err := b.api.GetJson(repositoryUrl+"/branches/default", &defaultBranch); err != nil {
+		return "", err
+	}
+	var root bitbucketServerBrowsePage
+	if _, err := b.api.GetJson(repositoryUrl+"/browse?limit=1000&at="+url.QueryEscape(defaultBranch.Id), &root); err != nil {
+		return "", err
+	}
+	var fileNames []string
+	for _, file := range root.Children.Values {
+		if file.Type == "FILE" {
+			fileNames = append(fileNames, file.Path.Name)
 		}
 	}
-	if !found {
-		cloneUrl = b.repo.Repository.Links["clone"][0]["href"]
+	readme := selectReadme(fileNames)
+	if readme == "" {
+		return "", nil
 	}
-	if err := runGitClone(cloneUrl); err != nil {
-		log.Fatalf("Could not clone %s: %v", cloneUrl, err)
+	var baseLink = fmt.Sprintf("%s/projects/%s/repos/%s",
+		strings.TrimSuffix(b.httpUrl, "/"), url.PathEscape(repository.ProjectKey), url.PathEscape(repository.Slug))
+	var readmeLink = baseLink + "/raw/" + url.PathEscape(readme) + "?at=" + url.QueryEscape(defaultBranch.Id)
+	response, err := b.api.Get(readmeLink, readmeDownloadLimit(b.readmeMaxSize))
+	if err != nil {
+		return "", err
 	}
-	return "Cloned " + cloneUrl
+	return cleanReadme(string(response.Body), b.readmeMaxSize), nil
+}
+
+func (b *BitbucketServerModule) HostedRepositories() []HostedRepository {
+	return b.repositories
+}
+
+func (b *BitbucketServerModule) WriteExternalData(file *os.File) {
+	writeRepositoryCache(file, b.repositories)
+}
+
+func (b *BitbucketServerModule) ReadExternalData(data []byte) error {
+	return readRepositoryCache(data, &b.repositories, func() []string {
+		var fullNames []string
+		for _, repo := range b.repositories {
+			fullNames = append(fullNames, repo.FullName)
+		}
+		return fullNames
+	})
 }
 
 func (b *BitbucketServerModule) CreateActions(tags []Tag) []action {
 	var actions []action
-	for _, repo := range b.repositoriesWithReadme {
-		strs := []string{"bitbucket", "browse", repo.Repository.Name, repo.Readme, repo.Repository.Project.Name}
-		if DoMatch(strs, tags) {
-			actions = append(actions, BitbucketServerBrowseAction{repo: repo})
-		}
-		strs = []string{"bitbucket", "clone", repo.Repository.Name, repo.Readme, repo.Repository.Project.Name}
-		if DoMatch(strs, tags) {
-			actions = append(actions, BitbucketServerCloneAction{repo: repo})
-		}
+	for _, repo := range b.repositories {
+		actions = append(actions, CreateRepositoryActions(b, repo, tags, nil)...)
 	}
 	return actions
 }
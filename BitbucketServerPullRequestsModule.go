@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// BitbucketServerPullRequestsModule indexes the open pull requests of all
+// repositories known to the bitbucket server module. It uses the settings of
+// the bitbucket server module.
+type BitbucketServerPullRequestsModule struct {
+	bitbucketServerModule *BitbucketServerModule
+	pullRequests          []BitbucketServerPullRequest
+}
+
+type BitbucketServerUser struct {
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	DisplayName string `json:"displayName"`
+}
+
+type BitbucketServerParticipant struct {
+	User     BitbucketServerUser `json:"user"`
+	Role     string              `json:"role"`
+	Approved bool                `json:"approved"`
+	// Status is one of UNAPPROVED, NEEDS_WORK or APPROVED
+	Status string `json:"status"`
+}
+
+type BitbucketServerPullRequestRef struct {
+	Id         string                    `json:"id"`
+	DisplayId  string                    `json:"displayId"`
+	Repository bitbucketServerRepository `json:"repository"`
+}
+
+type BitbucketServerPullRequest struct {
+	Id        int                           `json:"id"`
+	Title     string                        `json:"title"`
+	State     string                        `json:"state"`
+	Author    BitbucketServerParticipant    `json:"author"`
+	Reviewers []BitbucketServerParticipant  `json:"reviewers"`
+	FromRef   BitbucketServerPullRequestRef `json:"fromRef"`
+	ToRef     BitbucketServerPullRequestRef `json:"toRef"`
+	Links     struct {
+		Self []BitbucketLink `json:"self"`
+	} `json:"links"`
+}
+
+func NewBitbucketServerPullRequestsModule(bitbucketServerModule *BitbucketServerModule) *BitbucketServerPullRequestsModule {
+	p := new(BitbucketServerPullRequestsModule)
+	p.bitbucketServerModule = bitbucketServerModule
+	return p
+}
+
+func (p *BitbucketServerPullRequestsModule) Name() string {
+	return "BitbucketServerPullRequests"
+}
+
+func (p *BitbucketServerPullRequestsModule) Description() string {
+	return "Provides access to open bitbucket server pull requests"
+}
+
+func (p *BitbucketServerPullRequestsModule) CanBeDisabled() bool {
+	return true
+}
+
+func (p *BitbucketServerPullRequestsModule) UpdateSettings() {
+	// We need the settings even if the bitbucket server module is not active
+	p.bitbucketServerModule.UpdateSettings()
+}
+
+func (p *BitbucketServerPullRequestsModule) NeedsExternalData() bool {
+	return true
+}
+
+func (p *BitbucketServerPullRequestsModule) UpdateExternalData() {
+	b := p.bitbucketServerModule
+	repositories := b.repositories
+	if len(repositories) == 0 {
+		var err error
+		if repositories, err = b.ListRepositories(); err != nil {
+			log.Fatalf("Cannot list bitbucket server repositories: %v", err)
+		}
+	}
+
+	pullRequestsPerRepository := make([][]BitbucketServerPullRequest, len(repositories))
+	forEachConcurrently(len(repositories), func(i int) {
+		pullRequests, err := p.LoadPullRequests(repositories[i])
+		if err != nil {
+			log.Fatalf("Cannot get pull requests for %s: %v", repositories[i].FullName, err)
+		}
+		pullRequestsPerRepository[i] = pullRequests
+	})
+	var allPullRequests []BitbucketServerPullRequest
+	for _, pullRequests := range pullRequestsPerRepository {
+		allPullRequests = append(allPullRequests, pullRequests...)
+	}
+	p.pullRequests = allPullRequests
+	fmt.Printf("  - Updated %d pull requests\n", len(allPullRequests))
+}
+
+// LoadPullRequests loads the open pull requests of a repository
+func (p *BitbucketServerPullRequestsModule) LoadPullRequests(repository HostedRepository) ([]BitbucketServerPullRequest, error) {
+	b := p.bitbucketServerModule
+	var pullRequests []BitbucketServerPullRequest
+	pullRequestsUrl := b.restUrl("projects", repository.ProjectKey, "repos", repository.Slug, "pull-requests") + "?state=OPEN"
+	err := b.getPages("pull requests of "+repository.Name, pullRequestsUrl, func(values json.RawMessage) (int, error) {
+		var page []BitbucketServerPullRequest
+		err := json.Unmarshal(values, &page)
+		pullRequests = append(pullRequests, page...)
+		return len(page), err
+	})
+	return pullRequests, err
+}
+
+func (p *BitbucketServerPullRequestsModule) WriteExternalData(file *os.File) {
+	bytes, err := json.Marshal(p.pullRequests)
+	if err != nil {
+		log.Fatalf("Cannot serialize pull request data: %s", err)
+	}
+	if _, err = file.Write(bytes); err != nil {
+		log.Fatalf("Cannot write pull request data to %v: %s", file, err)
+	}
+}
+
+func (p *BitbucketServerPullRequestsModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &p.pullRequests)
+}
+
+func (u BitbucketServerUser) is(username string) bool {
+	return username != "" && (strings.EqualFold(u.Name, username) || strings.EqualFold(u.Slug, username))
+}
+
+func (pr BitbucketServerPullRequest) isAuthor(username string) bool {
+	return pr.Author.User.is(username)
+}
+
+// isReviewRequested is true if the user is a reviewer and did not approve yet
+func (pr BitbucketServerPullRequest) isReviewRequested(username string) bool {
+	for _, reviewer := range pr.Reviewers {
+		if reviewer.User.is(username) {
+			return !reviewer.Approved
+		}
+	}
+	return false
+}
+
+// userSlug is the slug of the user in the pull request urls. It is usually the
+// lower case username, but the reviewers know better.
+func (pr BitbucketServerPullRequest) userSlug(username string) string {
+	for _, reviewer := range pr.Reviewers {
+		if reviewer.User.is(username) && reviewer.User.Slug != "" {
+			return reviewer.User.Slug
+		}
+	}
+	return strings.ToLower(username)
+}
+
+func (pr BitbucketServerPullRequest) label(verb string) string {
+	return "[bitbucket-server-pr[] " + verb + " " + pr.ToRef.Repository.Name + "#" + strconv.Itoa(pr.Id) + " " + pr.Title + " (" + pr.Author.User.DisplayName + ")"
+}
+
+type BitbucketServerPullRequestBrowseAction struct {
+	pullRequest BitbucketServerPullRequest
+}
+
+func (b BitbucketServerPullRequestBrowseAction) GetLabel() string {
+	return b.pullRequest.label("BROWSE")
+}
+
+func (b BitbucketServerPullRequestBrowseAction) Run() string {
+	if len(b.pullRequest.Links.Self) == 0 {
+		log.Fatalf("Bitbucket sent no link for pull request #%d", b.pullRequest.Id)
+	}
+	url := b.pullRequest.Links.Self[0].Href
+	if err := launchUrl(url); err != nil {
+		log.Fatalf("Could not browse %s: %v", url, err)
+	}
+	return "Opened " + url
+}
+
+type BitbucketServerPullRequestApproveAction struct {
+	pullRequest           BitbucketServerPullRequest
+	bitbucketServerModule *BitbucketServerModule
+}
+
+func (b BitbucketServerPullRequestApproveAction) GetLabel() string {
+	return b.pullRequest.label("APPROVE")
+}
+
+func (b BitbucketServerPullRequestApproveAction) Run() string {
+	pr := b.pullRequest
+	username := b.bitbucketServerModule.username
+	repository := pr.ToRef.Repository
+	participantUrl := b.bitbucketServerModule.restUrl("projects", repository.Project.Key, "repos", repository.Slug,
+		"pull-requests", strconv.Itoa(pr.Id), "participants", pr.userSlug(username))
+	participant := BitbucketServerParticipant{
+		User:     BitbucketServerUser{Name: username},
+		Approved: true,
+		Status:   "APPROVED",
+	}
+	if err := b.bitbucketServerModule.api.SendJson("PUT", participantUrl, participant, nil); err != nil {
+		log.Fatalf("Could not approve pull request #%d: %v", pr.Id, err)
+	}
+	return fmt.Sprintf("Approved %s#%d %s", repository.Name, pr.Id, pr.Title)
+}
+
+type BitbucketServerPullRequestCheckoutAction struct {
+	pullRequest           BitbucketServerPullRequest
+	bitbucketServerModule *BitbucketServerModule
+}
+
+func (b BitbucketServerPullRequestCheckoutAction) GetLabel() string {
+	return b.pullRequest.label("CHECKOUT")
+}
+
+// Run checks out the source branch in the local clone of the destination
+// repository
+func (b BitbucketServerPullRequestCheckoutAction) Run() string {
+	pr := b.pullRequest
+	var host string
+	if parsedUrl, err := url.Parse(b.bitbucketServerModule.httpUrl); err == nil {
+		host = parsedUrl.Hostname()
+	}
+	cloneSettings := b.bitbucketServerModule.cloneSettings
+	destination := hostedBitbucketServerRepository(host, pr.ToRef.Repository)
+	target, err := destination.CloneTarget(cloneSettings, pr.FromRef.DisplayId)
+	if err != nil {
+		log.Fatalf("Cannot clone repo %s: %v", destination.FullName, err)
+	}
+	sourceUrl := ""
+	if source := hostedBitbucketServerRepository(host, pr.FromRef.Repository); source.FullName != destination.FullName {
+		// Pull request from a fork
+		sourceUrl, err = gitModule.SelectCloneUrl(source.CloneLinks, cloneSettings)
+		if err != nil {
+			log.Fatalf("Cannot fetch from %s: %v", source.FullName, err)
+		}
+	}
+	message, err := gitModule.Checkout(target, sourceUrl)
+	if err != nil {
+		log.Fatalf("Could not check out pull request #%d: %v", pr.Id, err)
+	}
+	return message
+}
+
+func (p *BitbucketServerPullRequestsModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	username := p.bitbucketServerModule.username
+	for _, pr := range p.pullRequests {
+		strs := []string{
+			"bitbucket", "bitbucket-server", "pr", "pull-request", pr.State, pr.Title, pr.ToRef.Repository.Name,
+			pr.ToRef.Repository.Project.Name, pr.FromRef.DisplayId, pr.ToRef.DisplayId, pr.Author.User.DisplayName, pr.Author.User.Name,
+		}
+		for _, reviewer := range pr.Reviewers {
+			strs = append(strs, reviewer.User.DisplayName, reviewer.User.Name)
+		}
+		if pr.isAuthor(username) {
+			strs = append(strs, "mine")
+		}
+		if pr.isReviewRequested(username) {
+			strs = append(strs, "review-requested")
+		}
+		if DoMatch(append(strs, "browse"), tags) {
+			actions = append(actions, BitbucketServerPullRequestBrowseAction{pullRequest: pr})
+		}
+		if DoMatch(append(strs, "checkout"), tags) {
+			actions = append(actions, BitbucketServerPullRequestCheckoutAction{pullRequest: pr, bitbucketServerModule: p.bitbucketServerModule})
+		}
+		if !pr.isAuthor(username) && DoMatch(append(strs, "approve"), tags) {
+			actions = append(actions, BitbucketServerPullRequestApproveAction{pullRequest: pr, bitbucketServerModule: p.bitbucketServerModule})
+		}
+	}
+	return actions
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ConfluenceModule indexes the pages of configured confluence spaces. Searches
+// without a hit in the index can be sent to confluence.
+type ConfluenceModule struct {
+	httpUrl        string
+	username       string
+	token          string
+	spaces         []string
+	excerpts       bool
+	excerptMaxSize int
+	api            *ApiClient
+	pages          []ConfluencePage
+}
+
+type ConfluencePage struct {
+	Id        string   `json:"id"`
+	Title     string   `json:"title"`
+	SpaceKey  string   `json:"spaceKey"`
+	SpaceName string   `json:"spaceName"`
+	Labels    []string `json:"labels"`
+	// Excerpt is the beginning of the page text, if excerpts are enabled
+	Excerpt string `json:"excerpt,omitempty"`
+	WebUrl  string `json:"webUrl"`
+}
+
+type confluenceContent struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+	Space struct {
+		Key  string `json:"key"`
+		Name string `json:"name"`
+	} `json:"space"`
+	Metadata struct {
+		Labels struct {
+			Results []struct {
+				Name string `json:"name"`
+			} `json:"results"`
+		} `json:"labels"`
+	} `json:"metadata"`
+	Body struct {
+		View struct {
+			Value string `json:"value"`
+		} `json:"view"`
+	} `json:"body"`
+	Links struct {
+		WebUi string `json:"webui"`
+	} `json:"_links"`
+}
+
+type confluenceContentPage struct {
+	Results []confluenceContent `json:"results"`
+	Links   struct {
+		Next string `json:"next"`
+	} `json:"_links"`
+}
+
+// confluenceSearchLimit is the number of results of a live search
+const confluenceSearchLimit = 20
+
+func NewConfluenceModule() *ConfluenceModule {
+	return new(ConfluenceModule)
+}
+
+func (c *ConfluenceModule) Name() string {
+	return "Confluence"
+}
+
+func (c *ConfluenceModule) Description() string {
+	return "Provides access to confluence pages"
+}
+
+func (c *ConfluenceModule) CanBeDisabled() bool {
+	return true
+}
+
+func (c *ConfluenceModule) UpdateSettings() {
+	configKey := c.Name() + ".http-url"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'https://example.atlassian.net/wiki')", configKey)
+	}
+	c.httpUrl = strings.TrimSuffix(viper.GetString(configKey), "/")
+
+	configKey = c.Name() + ".token"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'confluence_api_token')", configKey)
+	}
+	c.token = viper.GetString(configKey)
+	// Confluence cloud needs the email address with the api token, data
+	// center accepts a personal access token alone.
+	c.username = viper.GetString(c.Name() + ".username")
+
+	configKey = c.Name() + ".spaces"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. '[DEV, OPS]')", configKey)
+	}
+	c.spaces = viper.GetStringSlice(configKey)
+
+	c.excerpts = viper.GetBool(c.Name() + ".excerpts")
+	c.excerptMaxSize = 1024
+	if configKey = c.Name() + ".excerpt-max-size"; viper.IsSet(configKey) {
+		c.excerptMaxSize = viper.GetInt(configKey)
+	}
+	c.api = NewApiClient(c.Name(), BasicOrBearerAuth(c.username, c.token))
+}
+
+func (c *ConfluenceModule) NeedsExternalData() bool {
+	return true
+}
+
+func (c *ConfluenceModule) UpdateExternalData() {
+	var pages []ConfluencePage
+	for _, space := range c.spaces {
+		spacePages, err := c.ListPages(space)
+		if err != nil {
+			log.Fatalf("Cannot list pages of confluence space %s: %v", space, err)
+		}
+		fmt.Printf("  - %d pages in space %s\n", len(spacePages), space)
+		pages = append(pages, spacePages...)
+	}
+	c.pages = pages
+}
+
+// ListPages returns the current pages of a space
+func (c *ConfluenceModule) ListPages(space string) ([]ConfluencePage, error) {
+	expand := "space,metadata.labels"
+	if c.excerpts {
+		expand += ",body.view"
+	}
+	query := url.Values{}
+	query.Set("spaceKey", space)
+	query.Set("type", "page")
+	query.Set("status", "current")
+	query.Set("expand", expand)
+	query.Set("limit", "50")
+	var pages []ConfluencePage
+	pageUrl := c.httpUrl + "/rest/api/content?" + query.Encode()
+	for pageUrl != "" {
+		var page confluenceContentPage
+		if _, err := c.api.GetJson(pageUrl, &page); err != nil {
+			return nil, err
+		}
+		for _, content := range page.Results {
+			pages = append(pages, c.confluencePage(content))
+		}
+		pageUrl = ""
+		if page.Links.Next != "" && len(page.Results) > 0 {
+			pageUrl = c.httpUrl + page.Links.Next
+		}
+	}
+	return pages, nil
+}
+
+func (c *ConfluenceModule) confluencePage(content confluenceContent) ConfluencePage {
+	page := ConfluencePage{
+		Id:        content.Id,
+		Title:     content.Title,
+		SpaceKey:  content.Space.Key,
+		SpaceName: content.Space.Name,
+		WebUrl:    c.httpUrl + content.Links.WebUi,
+	}
+	for _, label := range content.Metadata.Labels.Results {
+		page.Labels = append(page.Labels, label.Name)
+	}
+	if c.excerpts {
+		page.Excerpt = cleanReadme(content.Body.View.Value, c.excerptMaxSize)
+	}
+	return page
+}
+
+// Search runs a CQL full text search for the text
+func (c *ConfluenceModule) Search(text string) ([]ConfluencePage, error) {
+	cql := `type = page AND text ~ "` + strings.ReplaceAll(text, `"`, `\"`) + `"`
+	query := url.Values{}
+	query.Set("cql", cql)
+	query.Set("expand", "space")
+	query.Set("limit", strconv.Itoa(confluenceSearchLimit))
+	var result confluenceContentPage
+	if _, err := c.api.GetJson(c.httpUrl+"/rest/api/content/search?"+query.Encode(), &result); err != nil {
+		return nil, err
+	}
+	var pages []ConfluencePage
+	for _, content := range result.Results {
+		pages = append(pages, c.confluencePage(content))
+	}
+	return pages, nil
+}
+
+func (c *ConfluenceModule) WriteExternalData(file *os.File) {
+	bytes, err := json.Marshal(c.pages)
+	if err != nil {
+		log.Fatalf("Cannot serialize confluence pages: %s", err)
+	}
+	if _, err = file.Write(bytes); err != nil {
+		log.Fatalf("Cannot write confluence pages to %v: %s", file, err)
+	}
+}
+
+func (c *ConfluenceModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &c.pages)
+}
+
+type ConfluenceBrowseAction struct {
+	page ConfluencePage
+}
+
+func (c ConfluenceBrowseAction) GetLabel() string {
+	return "[confluence[] BROWSE " + c.page.SpaceKey + ": " + c.page.Title
+}
+
+func (c ConfluenceBrowseAction) Run() string {
+	if err := launchUrl(c.page.WebUrl); err != nil {
+		log.Fatalf("Could not browse %s: %v", c.page.WebUrl, err)
+	}
+	return "Opened " + c.page.WebUrl
+}
+
+type ConfluenceSearchAction struct {
+	text             string
+	confluenceModule *ConfluenceModule
+}
+
+func (c ConfluenceSearchAction) GetLabel() string {
+	return "[confluence[] SEARCH " + c.text
+}
+
+// Run lists the pages found by confluence and asks which one to open
+func (c ConfluenceSearchAction) Run() string {
+	pages, err := c.confluenceModule.Search(c.text)
+	if err != nil {
+		log.Fatalf("Could not search confluence for %s: %v", c.text, err)
+	}
+	if len(pages) == 0 {
+		return "No confluence pages found for " + c.text
+	}
+	for n, page := range pages {
+		fmt.Printf("%d) %s: %s\n", n+1, page.SpaceKey, page.Title)
+	}
+	choice, err := strconv.Atoi(prompt("Page:", "1"))
+	if err != nil || choice < 1 || choice > len(pages) {
+		return "Cancelled"
+	}
+	return ConfluenceBrowseAction{page: pages[choice-1]}.Run()
+}
+
+func (c *ConfluenceModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	for _, page := range c.pages {
+		strs := []string{"confluence", "wiki", "browse", page.Title, page.SpaceKey, page.SpaceName, page.Excerpt}
+		if DoMatch(append(strs, page.Labels...), tags) {
+			actions = append(actions, ConfluenceBrowseAction{page: page})
+		}
+	}
+	if len(actions) > 0 || len(tags) == 0 {
+		return actions
+	}
+	var words []string
+	for _, tag := range tags {
+		if tag.matchMode != Contains {
+			// Like with ddg: exact and prefix searches are not meant for
+			// a full text search
+			return actions
+		}
+		if tag.value != "" && tag.value != "confluence" && tag.value != "wiki" {
+			words = append(words, tag.value)
+		}
+	}
+	if len(words) == 0 {
+		return actions
+	}
+	return []action{ConfluenceSearchAction{text: strings.Join(words, " "), confluenceModule: c}}
+}
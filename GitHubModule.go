@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/spf13/viper"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// GitHubModule indexes the repositories of github.com or a github enterprise
+// installation.
+type GitHubModule struct {
+	apiUrl             string
+	token              string
+	organizations      []string
+	api                *ApiClient
+	cloneSettings      CloneSettings
+	readmeMaxSize      int
+	data               GitHubData
+	notificationModule *DelegatingNotificationsModule
+	// previous is the data before the current update. It provides the
+	// responses for conditional requests that github answers with 304.
+	previous GitHubData
+	// mutex guards the etags while READMEs are loaded concurrently
+	mutex sync.Mutex
+}
+
+type GitHubData struct {
+	Repositories []HostedRepository `json:"repositories"`
+	// Pages are the repository listings by url
+	Pages map[string]GitHubPage `json:"pages"`
+	// ReadmeETags are the etags of the READMEs by full name of the repository
+	ReadmeETags map[string]string `json:"readmeETags"`
+}
+
+// GitHubPage is a page of a repository listing. We only keep the full names,
+// since the repositories themselves are cached anyway.
+type GitHubPage struct {
+	ETag      string   `json:"etag"`
+	Next      string   `json:"next"`
+	FullNames []string `json:"fullNames"`
+}
+
+type gitHubRepository struct {
+	Name          string   `json:"name"`
+	FullName      string   `json:"full_name"`
+	HtmlUrl       string   `json:"html_url"`
+	CloneUrl      string   `json:"clone_url"`
+	SshUrl        string   `json:"ssh_url"`
+	DefaultBranch string   `json:"default_branch"`
+	UpdatedAt     string   `json:"updated_at"`
+	Topics        []string `json:"topics"`
+	Owner         struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+}
+
+// gitHubResponse is the result of a (conditional) GET request
+type gitHubResponse struct {
+	body        []byte
+	etag        string
+	next        string
+	notModified bool
+	notFound    bool
+}
+
+func NewGitHubModule(notificationModule *DelegatingNotificationsModule) *GitHubModule {
+	g := new(GitHubModule)
+	g.notificationModule = notificationModule
+	return g
+}
+
+func (g *GitHubModule) Name() string {
+	return "GitHub"
+}
+
+func (g *GitHubModule) Description() string {
+	return "Provides access to github repositories"
+}
+
+func (g *GitHubModule) CanBeDisabled() bool {
+	return true
+}
+
+func (g *GitHubModule) UpdateSettings() {
+	g.apiUrl = "https://api.github.com"
+	if configKey := g.Name() + ".api-url"; viper.IsSet(configKey) {
+		g.apiUrl = strings.TrimSuffix(viper.GetString(configKey), "/")
+	}
+
+	configKey := g.Name() + ".token"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'ghp_...')", configKey)
+	}
+	g.token = viper.GetString(configKey)
+
+	g.organizations = viper.GetStringSlice(g.Name() + ".organizations")
+	g.api = NewApiClient(g.Name(), BearerAuth(g.token))
+	g.cloneSettings = ReadCloneSettings(g.Name(), "ssh")
+	g.readmeMaxSize = readReadmeMaxSize(g.Name())
+}
+
+func (g *GitHubModule) NeedsExternalData() bool {
+	return true
+}
+
+func (g *GitHubModule) Label() string {
+	return "[github[]"
+}
+
+func (g *GitHubModule) Keywords() []string {
+	return []string{"github"}
+}
+
+func (g *GitHubModule) CloneSettings() CloneSettings {
+	return g.cloneSettings
+}
+
+func (g *GitHubModule) UpdateExternalData() {
+	g.previous = g.data
+	g.data = GitHubData{
+		Pages:       make(map[string]GitHubPage),
+		ReadmeETags: make(map[string]string),
+	}
+	repositories := IndexRepositories(g)
+	newRepos := NewRepositories(g.previous.Repositories, repositories)
+	if len(newRepos) > 0 {
+		g.notificationModule.AddNotification(RepositoryNotification("New github repositories found", "https://github.githubassets.com/favicons/favicon.png", newRepos))
+	}
+	g.data.Repositories = repositories
+}
+
+// ListRepositories lists the repositories of the user (including the ones of
+// the organizations the user belongs to) and of the configured organizations.
+func (g *GitHubModule) ListRepositories() ([]HostedRepository, error) {
+	listings := []string{g.apiUrl + "/user/repos?per_page=100&affiliation=owner,collaborator,organization_member"}
+	for _, organization := range g.organizations {
+		listings = append(listings, g.apiUrl+"/orgs/"+url.PathEscape(organization)+"/repos?per_page=100")
+	}
+	var repositories []HostedRepository
+	found := make(map[string]bool)
+	for _, listing := range listings {
+		listed, err := g.listRepositories(listing)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range listed {
+			if !found[repo.FullName] {
+				found[repo.FullName] = true
+				repositories = append(repositories, repo)
+			}
+		}
+	}
+	return repositories, nil
+}
+
+// listRepositories follows the pages of a listing. Pages that did not change
+// since the last update are taken from the cache.
+func (g *GitHubModule) listRepositories(pageUrl string) ([]HostedRepository, error) {
+	var repositories []HostedRepository
+	for pageUrl != "" {
+		cached := g.previous.Pages[pageUrl]
+		cachedRepositories := g.cachedRepositories(cached.FullNames)
+		etag := ""
+		if len(cachedRepositories) == len(cached.FullNames) {
+			etag = cached.ETag
+		}
+		response, err := g.get(pageUrl, etag, "application/vnd.github+json", -1)
+		if err != nil {
+			return nil, err
+		}
+		page := GitHubPage{ETag: response.etag, Next: response.next}
+		var pageRepositories []HostedRepository
+		if response.notModified {
+			page = cached
+			pageRepositories = cachedRepositories
+		} else {
+			var values []gitHubRepository
+			if err := json.Unmarshal(response.body, &values); err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				pageRepositories = append(pageRepositories, hostedGitHubRepository(value))
+				page.FullNames = append(page.FullNames, value.FullName)
+			}
+		}
+		g.data.Pages[pageUrl] = page
+		repositories = append(repositories, pageRepositories...)
+		pageUrl = page.Next
+	}
+	return repositories, nil
+}
+
+func (g *GitHubModule) cachedRepositories(fullNames []string) []HostedRepository {
+	var repositories []HostedRepository
+	for _, fullName := range fullNames {
+		for _, repo := range g.previous.Repositories {
+			if repo.FullName == fullName {
+				repo.Readme = ""
+				repositories = append(repositories, repo)
+				break
+			}
+		}
+	}
+	return repositories
+}
+
+func hostedGitHubRepository(repository gitHubRepository) HostedRepository {
+	var host string
+	if parsedUrl, err := url.Parse(repository.HtmlUrl); err == nil {
+		host = parsedUrl.Hostname()
+	}
+	return HostedRepository{
+		Name:          repository.Name,
+		FullName:      repository.FullName,
+		Project:       repository.Owner.Login,
+		ProjectKey:    repository.Owner.Login,
+		Slug:          repository.Name,
+		DefaultBranch: repository.DefaultBranch,
+		WebUrl:        repository.HtmlUrl,
+		CloneLinks: []CloneLink{
+			{Name: "ssh", Href: repository.SshUrl},
+			{Name: "https", Href: repository.CloneUrl},
+		},
+		Host:      host,
+		Workspace: repository.Owner.Login,
+		UpdatedOn: repository.UpdatedAt,
+		Topics:    repository.Topics,
+	}
+}
+
+// GetReadmeText returns the README that github chose for the repository
+// without markup. Unchanged READMEs are taken from the cache.
+func (g *GitHubModule) GetReadmeText(repository HostedRepository) (string, error) {
+	g.mutex.Lock()
+	etag := g.previous.ReadmeETags[repository.FullName]
+	g.mutex.Unlock()
+	readmeUrl := g.apiUrl + "/repos/" + repository.FullName + "/readme"
+	response, err := g.get(readmeUrl, etag, "application/vnd.github.raw", readmeDownloadLimit(g.readmeMaxSize))
+	if err != nil || response.notFound {
+		return "", err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if response.notModified {
+		g.data.ReadmeETags[repository.FullName] = etag
+		for _, previous := range g.previous.Repositories {
+			if previous.FullName == repository.FullName {
+				return previous.Readme, nil
+			}
+		}
+		return "", nil
+	}
+	g.data.ReadmeETags[repository.FullName] = response.etag
+	return cleanReadme(string(response.body), g.readmeMaxSize), nil
+}
+
+// get sends a GET request that is conditional if etag is set. It returns the
+// first limit bytes of the response or everything if limit is negative.
+func (g *GitHubModule) get(url string, etag string, accept string, limit int64) (gitHubResponse, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return gitHubResponse{}, err
+	}
+	req.Header.Set("Accept", accept)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := g.api.Do(req, limit)
+	response := gitHubResponse{
+		body: resp.Body,
+		etag: resp.Header.Get("ETag"),
+		next: resp.Next(),
+	}
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		response.notModified = true
+		return response, nil
+	case http.StatusNotFound:
+		response.notFound = true
+		return response, nil
+	}
+	return response, err
+}
+
+func (g *GitHubModule) HostedRepositories() []HostedRepository {
+	return g.data.Repositories
+}
+
+func (g *GitHubModule) WriteExternalData(file *os.File) {
+	writeRepositoryCache(file, g.data)
+}
+
+func (g *GitHubModule) ReadExternalData(data []byte) error {
+	return readRepositoryCache(data, &g.data, func() []string {
+		var fullNames []string
+		for _, repo := range g.data.Repositories {
+			fullNames = append(fullNames, repo.FullName)
+		}
+		return fullNames
+	})
+}
+
+func (g *GitHubModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	for _, repo := range g.data.Repositories {
+		actions = append(actions, CreateRepositoryActions(g, repo, tags, nil)...)
+	}
+	return actions
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// GitLabModule indexes the projects, the open merge requests of the user and
+// optionally the latest pipelines of a gitlab installation.
+type GitLabModule struct {
+	httpUrl            string
+	token              string
+	api                *ApiClient
+	cloneSettings      CloneSettings
+	pipelines          bool
+	readmeMaxSize      int
+	data               GitLabData
+	notificationModule *DelegatingNotificationsModule
+}
+
+type GitLabData struct {
+	Projects      []GitLabProject      `json:"projects"`
+	MergeRequests []GitLabMergeRequest `json:"mergeRequests"`
+}
+
+// GitLabProject adds the gitlab specific data to the shared repository model
+type GitLabProject struct {
+	HostedRepository
+	// Pipeline is the latest pipeline of the default branch, if enabled
+	Pipeline *GitLabPipeline `json:"pipeline,omitempty"`
+}
+
+type gitLabProject struct {
+	Name              string   `json:"name"`
+	Path              string   `json:"path"`
+	PathWithNamespace string   `json:"path_with_namespace"`
+	WebUrl            string   `json:"web_url"`
+	SshUrlToRepo      string   `json:"ssh_url_to_repo"`
+	HttpUrlToRepo     string   `json:"http_url_to_repo"`
+	DefaultBranch     string   `json:"default_branch"`
+	LastActivityAt    string   `json:"last_activity_at"`
+	Topics            []string `json:"topics"`
+	// TagList are the topics before gitlab 14
+	TagList   []string `json:"tag_list"`
+	Namespace struct {
+		Name     string `json:"name"`
+		FullPath string `json:"full_path"`
+	} `json:"namespace"`
+}
+
+type gitLabTreeEntry struct {
+	Name string `json:"name"`
+	// blob or tree
+	Type string `json:"type"`
+}
+
+type GitLabUser struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+type GitLabMergeRequest struct {
+	Iid          int          `json:"iid"`
+	Title        string       `json:"title"`
+	WebUrl       string       `json:"web_url"`
+	SourceBranch string       `json:"source_branch"`
+	TargetBranch string       `json:"target_branch"`
+	Author       GitLabUser   `json:"author"`
+	Assignees    []GitLabUser `json:"assignees"`
+	References   struct {
+		Full string `json:"full"`
+	} `json:"references"`
+	// Scope is "created_by_me" or "assigned_to_me". Not part of the api response.
+	Scope string `json:"scope"`
+}
+
+func NewGitLabModule(notificationModule *DelegatingNotificationsModule) *GitLabModule {
+	g := new(GitLabModule)
+	g.notificationModule = notificationModule
+	return g
+}
+
+func (g *GitLabModule) Name() string {
+	return "GitLab"
+}
+
+func (g *GitLabModule) Description() string {
+	return "Provides access to gitlab projects, merge requests and pipelines"
+}
+
+func (g *GitLabModule) CanBeDisabled() bool {
+	return true
+}
+
+func (g *GitLabModule) UpdateSettings() {
+	configKey := g.Name() + ".http-url"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'https://gitlab.example.com')", configKey)
+	}
+	g.httpUrl = strings.TrimSuffix(viper.GetString(configKey), "/")
+
+	configKey = g.Name() + ".token"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'glpat-...')", configKey)
+	}
+	g.token = viper.GetString(configKey)
+
+	g.api = NewApiClient(g.Name(), HeaderAuth("PRIVATE-TOKEN", g.token))
+	g.cloneSettings = ReadCloneSettings(g.Name(), "ssh")
+	g.pipelines = viper.GetBool(g.Name() + ".pipelines")
+	g.readmeMaxSize = readReadmeMaxSize(g.Name())
+}
+
+func (g *GitLabModule) NeedsExternalData() bool {
+	return true
+}
+
+func (g *GitLabModule) Label() string {
+	return "[gitlab[]"
+}
+
+func (g *GitLabModule) Keywords() []string {
+	return []string{"gitlab"}
+}
+
+func (g *GitLabModule) CloneSettings() CloneSettings {
+	return g.cloneSettings
+}
+
+func (g *GitLabModule) UpdateExternalData() {
+	repositories := IndexRepositories(g)
+	projects := make([]GitLabProject, len(repositories))
+	forEachConcurrently(len(repositories), func(i int) {
+		project := GitLabProject{HostedRepository: repositories[i]}
+		if g.pipelines && project.DefaultBranch != "" {
+			pipeline, err := g.LoadLatestPipeline(project.FullName, project.DefaultBranch)
+			if err != nil {
+				fmt.Printf("  ! Cannot get pipelines for %s: %v\n", project.FullName, err)
+			}
+			project.Pipeline = pipeline
+		}
+		projects[i] = project
+	})
+	mergeRequests, err := g.LoadMergeRequests()
+	if err != nil {
+		log.Fatalf("Cannot get merge requests: %v", err)
+	}
+	fmt.Printf("  - Updated %d merge requests\n", len(mergeRequests))
+
+	newRepos := NewRepositories(g.HostedRepositories(), repositories)
+	if len(newRepos) > 0 {
+		g.notificationModule.AddNotification(RepositoryNotification("New gitlab projects found", g.httpUrl+"/favicon.ico", newRepos))
+	}
+	g.data = GitLabData{
+		Projects:      projects,
+		MergeRequests: mergeRequests,
+	}
+}
+
+func (g *GitLabModule) apiUrl(path string) string {
+	return g.httpUrl + "/api/v4/" + path
+}
+
+// gitLabProjectId is the path of a project escaped as a single path segment,
+// which the api accepts instead of the numeric id.
+func gitLabProjectId(fullName string) string {
+	return url.PathEscape(fullName)
+}
+
+// ListRepositories lists all projects the user is a member of, including the
+// ones in subgroups.
+func (g *GitLabModule) ListRepositories() ([]HostedRepository, error) {
+	var host string
+	if parsedUrl, err := url.Parse(g.httpUrl); err == nil {
+		host = parsedUrl.Hostname()
+	}
+	var repositories []HostedRepository
+	pageUrl := g.apiUrl("projects?membership=true&archived=false&order_by=id&sort=asc&per_page=100")
+	for pageUrl != "" {
+		var page []gitLabProject
+		response, err := g.api.GetJson(pageUrl, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range page {
+			repositories = append(repositories, hostedGitLabProject(host, project))
+		}
+		pageUrl = response.Next()
+	}
+	return repositories, nil
+}
+
+func hostedGitLabProject(host string, project gitLabProject) HostedRepository {
+	topics := project.Topics
+	if len(topics) == 0 {
+		topics = project.TagList
+	}
+	return HostedRepository{
+		Name:          project.Name,
+		FullName:      project.PathWithNamespace,
+		Project:       project.Namespace.FullPath,
+		ProjectKey:    project.Namespace.FullPath,
+		Slug:          project.Path,
+		DefaultBranch: project.DefaultBranch,
+		WebUrl:        project.WebUrl,
+		CloneLinks: []CloneLink{
+			{Name: "ssh", Href: project.SshUrlToRepo},
+			{Name: "https", Href: project.HttpUrlToRepo},
+		},
+		Host:      host,
+		Workspace: strings.Split(project.Namespace.FullPath, "/")[0],
+		UpdatedOn: project.LastActivityAt,
+		Topics:    topics,
+	}
+}
+
+// GetReadmeText pages through the repository tree. Empty projects have no
+// default branch and no README.
+func (g *GitLabModule) GetReadmeText(repository HostedRepository) (string, error) {
+	if repository.DefaultBranch == "" {
+		// Empty project
+		return "", nil
+	}
+	projectUrl := g.apiUrl("projects/" + gitLabProjectId(repository.FullName))
+	ref := url.QueryEscape(repository.DefaultBranch)
+	var fileNames []string
+	for pageUrl := projectUrl + "/repository/tree?per_page=100&ref=" + ref; pageUrl != ""; {
+		var page []gitLabTreeEntry
+		response, err := g.api.GetJson(pageUrl, &page)
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range page {
+			if entry.Type == "blob" {
+				fileNames = append(fileNames, entry.Name)
+			}
+		}
+		pageUrl = response.Next()
+	}
+	readme := selectReadme(fileNames)
+	if readme == "" {
+		return "", nil
+	}
+	response, err := g.api.Get(projectUrl+"/repository/files/"+url.PathEscape(readme)+"/raw?ref="+ref, readmeDownloadLimit(g.readmeMaxSize))
+	if err != nil {
+		return "", err
+	}
+	return cleanReadme(string(response.Body), g.readmeMaxSize), nil
+}
+
+// LoadMergeRequests loads the open merge requests that the user created or is
+// assigned to.
+func (g *GitLabModule) LoadMergeRequests() ([]GitLabMergeRequest, error) {
+	var mergeRequests []GitLabMergeRequest
+	found := make(map[string]bool)
+	for _, scope := range []string{"created_by_me", "assigned_to_me"} {
+		pageUrl := g.apiUrl("merge_requests?state=opened&per_page=100&scope=" + scope)
+		for pageUrl != "" {
+			var page []GitLabMergeRequest
+			response, err := g.api.GetJson(pageUrl, &page)
+			if err != nil {
+				return nil, err
+			}
+			for _, mergeRequest := range page {
+				if !found[mergeRequest.References.Full] {
+					found[mergeRequest.References.Full] = true
+					mergeRequest.Scope = scope
+					mergeRequests = append(mergeRequests, mergeRequest)
+				}
+			}
+			pageUrl = response.Next()
+		}
+	}
+	return mergeRequests, nil
+}
+
+func (g *GitLabModule) HostedRepositories() []HostedRepository {
+	var repositories []HostedRepository
+	for _, project := range g.data.Projects {
+		repositories = append(repositories, project.HostedRepository)
+	}
+	return repositories
+}
+
+func (g *GitLabModule) WriteExternalData(file *os.File) {
+	writeRepositoryCache(file, g.data)
+}
+
+func (g *GitLabModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &g.data)
+}
+
+type GitLabMergeRequestBrowseAction struct {
+	mergeRequest GitLabMergeRequest
+}
+
+func (g GitLabMergeRequestBrowseAction) GetLabel() string {
+	mr := g.mergeRequest
+	return "[gitlab-mr[] BROWSE " + mr.References.Full + " " + mr.Title + " (" + mr.Author.Name + ")"
+}
+
+func (g GitLabMergeRequestBrowseAction) Run() string {
+	if err := launchUrl(g.mergeRequest.WebUrl); err != nil {
+		log.Fatalf("Could not browse %s: %v", g.mergeRequest.WebUrl, err)
+	}
+	return "Opened " + g.mergeRequest.WebUrl
+}
+
+func (g *GitLabModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	for _, project := range g.data.Projects {
+		// Every level of the namespace is a tag, eg. `=backend` finds the
+		// projects of all subgroups of the backend group.
+		namespace := strings.Split(project.ProjectKey, "/")
+		actions = append(actions, CreateRepositoryActions(g, project.HostedRepository, tags, namespace)...)
+		actions = append(actions, g.createPipelineActions(project, tags)...)
+	}
+	for _, mr := range g.data.MergeRequests {
+		strs := []string{
+			"gitlab", "mr", "merge-request", "browse", mr.References.Full, mr.Title,
+			mr.SourceBranch, mr.TargetBranch, mr.Author.Name, mr.Author.Username, strconv.Itoa(mr.Iid),
+		}
+		for _, assignee := range mr.Assignees {
+			strs = append(strs, assignee.Name, assignee.Username)
+		}
+		if mr.Scope == "created_by_me" {
+			strs = append(strs, "mine")
+		} else {
+			strs = append(strs, "assigned")
+		}
+		if DoMatch(strs, tags) {
+			actions = append(actions, GitLabMergeRequestBrowseAction{mergeRequest: mr})
+		}
+	}
+	return actions
+}
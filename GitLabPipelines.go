@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+)
+
+type GitLabPipeline struct {
+	Id     int    `json:"id"`
+	Status string `json:"status"`
+	Ref    string `json:"ref"`
+	WebUrl string `json:"web_url"`
+}
+
+// LoadLatestPipeline returns the latest pipeline of the ref or nil if there is
+// none.
+func (g *GitLabModule) LoadLatestPipeline(fullName string, ref string) (*GitLabPipeline, error) {
+	pipelinesUrl := g.apiUrl("projects/" + gitLabProjectId(fullName) + "/pipelines?per_page=1&ref=" + url.QueryEscape(ref))
+	var pipelines []GitLabPipeline
+	if _, err := g.api.GetJson(pipelinesUrl, &pipelines); err != nil {
+		return nil, err
+	}
+	if len(pipelines) == 0 {
+		return nil, nil
+	}
+	return &pipelines[0], nil
+}
+
+func (g *GitLabModule) createPipelineActions(project GitLabProject, tags []Tag) []action {
+	var actions []action
+	if pipeline := project.Pipeline; pipeline != nil {
+		strs := []string{"gitlab", "pipeline", "browse", project.Name, project.Project, pipeline.Ref, pipeline.Status}
+		if DoMatch(strs, tags) {
+			actions = append(actions, GitLabPipelineBrowseAction{project: project, pipeline: *pipeline})
+		}
+	}
+	strs := []string{"gitlab", "pipeline", "run", "trigger", project.Name, project.Project}
+	if DoMatch(strs, tags) {
+		actions = append(actions, GitLabRunPipelineAction{project: project, gitLabModule: g})
+	}
+	return actions
+}
+
+type GitLabPipelineBrowseAction struct {
+	project  GitLabProject
+	pipeline GitLabPipeline
+}
+
+func (g GitLabPipelineBrowseAction) GetLabel() string {
+	return fmt.Sprintf("[gitlab[] PIPELINE %s %s #%d %s", g.project.Name, g.pipeline.Ref, g.pipeline.Id, g.pipeline.Status)
+}
+
+func (g GitLabPipelineBrowseAction) Run() string {
+	if err := launchUrl(g.pipeline.WebUrl); err != nil {
+		log.Fatalf("Could not browse %s: %v", g.pipeline.WebUrl, err)
+	}
+	return "Opened " + g.pipeline.WebUrl
+}
+
+type GitLabRunPipelineAction struct {
+	project      GitLabProject
+	gitLabModule *GitLabModule
+}
+
+func (g GitLabRunPipelineAction) GetLabel() string {
+	return "[gitlab[] RUN-PIPELINE " + g.project.Name
+}
+
+func (g GitLabRunPipelineAction) Run() string {
+	ref := prompt("Branch:", g.project.DefaultBranch)
+	pipelineUrl := g.gitLabModule.apiUrl("projects/" + gitLabProjectId(g.project.FullName) + "/pipeline")
+	var pipeline GitLabPipeline
+	if err := g.gitLabModule.api.SendJson("POST", pipelineUrl, map[string]string{"ref": ref}, &pipeline); err != nil {
+		log.Fatalf("Could not run pipeline for %s: %v", g.project.FullName, err)
+	}
+	return fmt.Sprintf("Started pipeline #%d on %s: %s", pipeline.Id, ref, pipeline.WebUrl)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitModule holds the settings that are shared by all modules that clone git
+// repositories.
+type GitModule struct {
+	cloneRoot         string
+	cloneDepth        int
+	recurseSubmodules bool
+	cloneBranch       string
+	postCloneCommands []string
+}
+
+// CloneSettings are the per module settings for cloning
+type CloneSettings struct {
+	// Protocol is one of ssh, https or auto
+	Protocol         string
+	CredentialHelper string
+}
+
+// CloneLink is a clone url as offered by the repository host. Name is the
+// protocol, eg. "ssh" or "https".
+type CloneLink struct {
+	Name string `json:"name"`
+	Href string `json:"href"`
+}
+
+type sshProbe struct {
+	Reachable bool      `json:"reachable"`
+	ProbedAt  time.Time `json:"probedAt"`
+}
+
+// sshProbeMaxAge is how long we trust the result of an ssh probe
+const sshProbeMaxAge = 24 * time.Hour
+
+// CloneTarget describes a repository to clone. The names are used to expand
+// the placeholders in the clone root and post clone commands.
+type CloneTarget struct {
+	Url       string
+	Host      string
+	Workspace string
+	Project   string
+	Repo      string
+	// Branch overrides the configured clone branch
+	Branch string
+	// CredentialHelper is used for https clones
+	CredentialHelper string
+}
+
+func NewGitModule() *GitModule {
+	return new(GitModule)
+}
+
+func (g *GitModule) Name() string {
+	return "Git"
+}
+
+func (g *GitModule) Description() string {
+	return "Configures how repositories are cloned"
+}
+
+func (g *GitModule) CanBeDisabled() bool {
+	return false
+}
+
+func (g *GitModule) UpdateSettings() {
+	// All settings are optional. Without them, we clone into the current
+	// working directory.
+	g.cloneRoot = viper.GetString(g.Name() + ".clone-root")
+	g.cloneDepth = viper.GetInt(g.Name() + ".clone-depth")
+	g.recurseSubmodules = viper.GetBool(g.Name() + ".recurse-submodules")
+	g.cloneBranch = viper.GetString(g.Name() + ".clone-branch")
+	g.postCloneCommands = viper.GetStringSlice(g.Name() + ".post-clone")
+}
+
+func (g *GitModule) NeedsExternalData() bool {
+	return false
+}
+
+func (g *GitModule) UpdateExternalData() {
+	// this intentionally empty
+}
+
+func (g *GitModule) WriteExternalData(_ *os.File) {
+	// this intentionally empty
+}
+
+func (g *GitModule) ReadExternalData(_ []byte) error {
+	// this intentionally empty
+	return nil
+}
+
+func (g *GitModule) CreateActions(_ []Tag) []action {
+	return []action{}
+}
+
+// ReadCloneSettings reads the clone settings from the config section of a
+// module.
+func ReadCloneSettings(moduleName string, defaultProtocol string) CloneSettings {
+	settings := CloneSettings{Protocol: defaultProtocol}
+	configKey := moduleName + ".clone-protocol"
+	if viper.IsSet(configKey) {
+		settings.Protocol = viper.GetString(configKey)
+	}
+	switch settings.Protocol {
+	case "ssh", "https", "auto":
+	default:
+		log.Fatalf("Invalid configuration key `%s` (ssh|https|auto)", configKey)
+	}
+	settings.CredentialHelper = viper.GetString(moduleName + ".credential-helper")
+	return settings
+}
+
+func isSshLink(link CloneLink) bool {
+	return link.Name == "ssh" || strings.HasPrefix(link.Href, "ssh://") || strings.HasPrefix(link.Href, "git@")
+}
+
+func isHttpsLink(link CloneLink) bool {
+	return link.Name == "https" || link.Name == "http" || strings.HasPrefix(link.Href, "https://") || strings.HasPrefix(link.Href, "http://")
+}
+
+// SelectCloneUrl picks the clone link for the configured protocol. In auto
+// mode, we use ssh if the ssh host is reachable.
+func (g *GitModule) SelectCloneUrl(links []CloneLink, settings CloneSettings) (string, error) {
+	var sshUrl, httpsUrl string
+	for _, link := range links {
+		if sshUrl == "" && isSshLink(link) {
+			sshUrl = link.Href
+		} else if httpsUrl == "" && isHttpsLink(link) {
+			httpsUrl = removePassword(link.Href)
+		}
+	}
+	switch settings.Protocol {
+	case "ssh":
+		if sshUrl == "" {
+			return "", fmt.Errorf("no ssh clone link found")
+		}
+		return sshUrl, nil
+	case "https":
+		if httpsUrl == "" {
+			return "", fmt.Errorf("no https clone link found")
+		}
+		return httpsUrl, nil
+	default:
+		if sshUrl != "" && (httpsUrl == "" || g.isSshReachable(sshUrl)) {
+			return sshUrl, nil
+		}
+		if httpsUrl == "" {
+			return "", fmt.Errorf("no ssh or https clone link found")
+		}
+		return httpsUrl, nil
+	}
+}
+
+// removePassword makes sure we never pass a password to git. The credential
+// helper should provide it.
+func removePassword(cloneUrl string) string {
+	parsedUrl, err := url.Parse(cloneUrl)
+	if err != nil || parsedUrl.User == nil {
+		return cloneUrl
+	}
+	if _, hasPassword := parsedUrl.User.Password(); hasPassword {
+		parsedUrl.User = url.User(parsedUrl.User.Username())
+	}
+	return parsedUrl.String()
+}
+
+// sshAddress extracts host:port from ssh://user@host:port/path and from scp
+// like user@host:path urls
+func sshAddress(sshUrl string) string {
+	if strings.HasPrefix(sshUrl, "ssh://") {
+		parsedUrl, err := url.Parse(sshUrl)
+		if err != nil {
+			return ""
+		}
+		if parsedUrl.Port() == "" {
+			return net.JoinHostPort(parsedUrl.Hostname(), "22")
+		}
+		return parsedUrl.Host
+	}
+	host := sshUrl[strings.Index(sshUrl, "@")+1:]
+	if i := strings.Index(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	return net.JoinHostPort(host, "22")
+}
+
+// isSshReachable connects to the ssh server once and remembers the result for
+// a while.
+func (g *GitModule) isSshReachable(sshUrl string) bool {
+	address := sshAddress(sshUrl)
+	cacheFile := LocateCacheFile("SshProbes")
+	probes := map[string]sshProbe{}
+	if data, err := ioutil.ReadFile(cacheFile); err == nil {
+		_ = json.Unmarshal(data, &probes)
+	}
+	if probe, found := probes[address]; found && time.Since(probe.ProbedAt) < sshProbeMaxAge {
+		return probe.Reachable
+	}
+	fmt.Printf("Checking ssh connectivity to %s\n", address)
+	probe := sshProbe{Reachable: probeSsh(address), ProbedAt: time.Now()}
+	probes[address] = probe
+	if data, err := json.Marshal(probes); err == nil {
+		if err := ioutil.WriteFile(cacheFile, data, 0644); err != nil {
+			fmt.Printf("Cannot write %s: %v\n", cacheFile, err)
+		}
+	}
+	return probe.Reachable
+}
+
+// probeSsh checks if there is an ssh server (and not eg. a proxy that accepts
+// anything) listening at the address.
+func probeSsh(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return false
+	}
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	return err == nil && strings.HasPrefix(banner, "SSH-")
+}
+
+func (t CloneTarget) expand(template string) string {
+	return strings.NewReplacer(
+		"{host}", t.Host,
+		"{workspace}", t.Workspace,
+		"{project}", t.Project,
+		"{repo}", t.Repo,
+	).Replace(template)
+}
+
+// Destination is the directory the target is cloned to
+func (g *GitModule) Destination(target CloneTarget) (string, error) {
+	if g.cloneRoot == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, strings.TrimSuffix(path.Base(target.Url), ".git")), nil
+	}
+	cloneRoot := g.cloneRoot
+	if !strings.Contains(cloneRoot, "{repo}") {
+		// Otherwise all repositories would end up in the same directory
+		cloneRoot = filepath.Join(cloneRoot, "{repo}")
+	}
+	destination, err := homedir.Expand(target.expand(cloneRoot))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(destination)
+}
+
+// Clone clones the target to its destination and runs the post clone commands.
+// If the target was cloned before, the user can fetch or open the existing
+// checkout instead.
+func (g *GitModule) Clone(target CloneTarget) (string, error) {
+	destination, err := g.Destination(target)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(destination); err == nil {
+		return g.handleExistingCheckout(destination)
+	}
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return "", err
+	}
+	args := []string{"clone"}
+	if target.CredentialHelper != "" && !strings.HasPrefix(target.Url, "ssh://") && !strings.HasPrefix(target.Url, "git@") {
+		args = append(args, "--config", "credential.helper="+target.CredentialHelper)
+	}
+	if g.cloneDepth > 0 {
+		args = append(args, "--depth", strconv.Itoa(g.cloneDepth))
+	}
+	if g.recurseSubmodules {
+		args = append(args, "--recurse-submodules")
+	}
+	branch := g.cloneBranch
+	if target.Branch != "" {
+		branch = target.Branch
+	}
+	if branch != "" {
+		args = append(args, "--branch", branch)
+	}
+	args = append(args, target.Url, destination)
+	if err := runGit("", args...); err != nil {
+		return "", err
+	}
+	for _, command := range g.postCloneCommands {
+		command = target.expand(command)
+		fmt.Printf("Running `%s`\n", command)
+		if err := runShell(destination, command); err != nil {
+			return "", fmt.Errorf("post clone command `%s` failed: %v", command, err)
+		}
+	}
+	return "Cloned " + target.Url + " to " + destination, nil
+}
+
+// Checkout checks out target.Branch in the local clone of the target. If there
+// is no local clone yet, we clone at that branch. sourceUrl is the repository
+// that holds the branch if it is not the target itself, eg. a fork.
+func (g *GitModule) Checkout(target CloneTarget, sourceUrl string) (string, error) {
+	dir, err := g.Destination(target)
+	if err != nil {
+		return "", err
+	}
+	branch := target.Branch
+	if _, err := os.Stat(dir); err != nil {
+		if sourceUrl != "" {
+			target.Branch = ""
+		}
+		message, err := g.Clone(target)
+		if err != nil || sourceUrl == "" {
+			return message, err
+		}
+	}
+	// Fetching into FETCH_HEAD works while the branch is checked out and
+	// for branches of forks, which have no remote tracking branch.
+	remote := "origin"
+	if sourceUrl != "" {
+		remote = sourceUrl
+	}
+	if err := runGit(dir, "fetch", remote, branch); err != nil {
+		return "", fmt.Errorf("could not fetch %s from %s: %v", branch, remote, err)
+	}
+	if !gitBranchExists(dir, branch) {
+		if err := runGit(dir, "checkout", "-b", branch, "FETCH_HEAD"); err != nil {
+			return "", fmt.Errorf("could not check out %s in %s: %v", branch, dir, err)
+		}
+		return "Checked out " + branch + " in " + dir, nil
+	}
+	// An existing local branch may have commits that were not pushed, so we
+	// only fast forward it
+	if err := runGit(dir, "checkout", branch); err != nil {
+		return "", fmt.Errorf("could not check out %s in %s: %v", branch, dir, err)
+	}
+	if err := runGit(dir, "merge", "--ff-only", "FETCH_HEAD"); err != nil {
+		return "", fmt.Errorf("%s in %s has diverged from %s, merge or reset it yourself: %v", branch, dir, remote, err)
+	}
+	return "Checked out " + branch + " in " + dir, nil
+}
+
+// gitBranchExists checks if there is a local branch of that name
+func gitBranchExists(dir string, branch string) bool {
+	return gitCommand(dir, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch).Run() == nil
+}
+
+func (g *GitModule) handleExistingCheckout(destination string) (string, error) {
+	if _, err := os.Stat(filepath.Join(destination, ".git")); err != nil {
+		return "", fmt.Errorf("%s already exists and is not a git checkout", destination)
+	}
+	fmt.Printf("Already cloned to %s. [f]etch, [o]pen or [c]ancel? (F/o/c) ", destination)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+	case "", "f", "fetch":
+		if err := runGit(destination, "fetch", "--all", "--prune"); err != nil {
+			return "", err
+		}
+		return "Fetched " + destination, nil
+	case "o", "open":
+		if err := launchUrl(destination); err != nil {
+			log.Fatalf("Could not open %s: %v", destination, err)
+		}
+		return "Opened " + destination, nil
+	default:
+		return "Nothing to do for " + destination, nil
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/mitchellh/go-homedir"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitModuleDestination(t *testing.T) {
+	home, err := homedir.Dir()
+	if err != nil {
+		t.Skip(err)
+	}
+	target := CloneTarget{Url: "git@bitbucket.org:acme/app.git", Host: "bitbucket.org", Workspace: "acme", Project: "OPS", Repo: "app"}
+	tests := []struct {
+		cloneRoot string
+		want      string
+	}{
+		{"~/src/{workspace}/{project}/{repo}", filepath.Join(home, "src", "acme", "OPS", "app")},
+		{"~/src/{repo}-{host}", filepath.Join(home, "src", "app-bitbucket.org")},
+		{"~/src/{workspace}", filepath.Join(home, "src", "acme", "app")},
+		{"~/src", filepath.Join(home, "src", "app")},
+	}
+	for _, test := range tests {
+		g := &GitModule{cloneRoot: test.cloneRoot}
+		got, err := g.Destination(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("Destination() with %q = %q, want %q", test.cloneRoot, got, test.want)
+		}
+	}
+}
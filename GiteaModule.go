@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// GiteaModule indexes the repositories and releases of a gitea or forgejo
+// installation.
+type GiteaModule struct {
+	httpUrl            string
+	token              string
+	api                *ApiClient
+	cloneSettings      CloneSettings
+	readmeMaxSize      int
+	repositories       []GiteaRepository
+	notificationModule *DelegatingNotificationsModule
+}
+
+// GiteaRepository adds the gitea specific data to the shared repository model
+type GiteaRepository struct {
+	HostedRepository
+	// Releases are the latest releases, newest first
+	Releases []GiteaRelease `json:"releases,omitempty"`
+}
+
+type GiteaRelease struct {
+	Name        string `json:"name"`
+	TagName     string `json:"tag_name"`
+	HtmlUrl     string `json:"html_url"`
+	PublishedAt string `json:"published_at"`
+	Prerelease  bool   `json:"prerelease"`
+	Draft       bool   `json:"draft"`
+}
+
+type giteaOwner struct {
+	Login    string `json:"login"`
+	FullName string `json:"full_name"`
+}
+
+type giteaRepository struct {
+	Name          string     `json:"name"`
+	FullName      string     `json:"full_name"`
+	HtmlUrl       string     `json:"html_url"`
+	SshUrl        string     `json:"ssh_url"`
+	CloneUrl      string     `json:"clone_url"`
+	DefaultBranch string     `json:"default_branch"`
+	UpdatedAt     string     `json:"updated_at"`
+	Empty         bool       `json:"empty"`
+	Topics        []string   `json:"topics"`
+	Owner         giteaOwner `json:"owner"`
+}
+
+type giteaContent struct {
+	Name string `json:"name"`
+	// file, dir, symlink or submodule
+	Type string `json:"type"`
+}
+
+// giteaReleaseLimit is the number of releases we keep per repository
+const giteaReleaseLimit = 10
+
+func NewGiteaModule(notificationModule *DelegatingNotificationsModule) *GiteaModule {
+	g := new(GiteaModule)
+	g.notificationModule = notificationModule
+	return g
+}
+
+func (g *GiteaModule) Name() string {
+	return "Gitea"
+}
+
+func (g *GiteaModule) Description() string {
+	return "Provides access to gitea and forgejo repositories"
+}
+
+func (g *GiteaModule) CanBeDisabled() bool {
+	return true
+}
+
+func (g *GiteaModule) UpdateSettings() {
+	configKey := g.Name() + ".http-url"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'https://gitea.example.com')", configKey)
+	}
+	g.httpUrl = strings.TrimSuffix(viper.GetString(configKey), "/")
+
+	configKey = g.Name() + ".token"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'gitea_token')", configKey)
+	}
+	g.token = viper.GetString(configKey)
+
+	g.api = NewApiClient(g.Name(), HeaderAuth("Authorization", "token "+g.token))
+	g.cloneSettings = ReadCloneSettings(g.Name(), "ssh")
+	g.readmeMaxSize = readReadmeMaxSize(g.Name())
+}
+
+func (g *GiteaModule) NeedsExternalData() bool {
+	return true
+}
+
+func (g *GiteaModule) Label() string {
+	return "[gitea[]"
+}
+
+func (g *GiteaModule) Keywords() []string {
+	return []string{"gitea", "forgejo"}
+}
+
+func (g *GiteaModule) CloneSettings() CloneSettings {
+	return g.cloneSettings
+}
+
+func (g *GiteaModule) UpdateExternalData() {
+	hostedRepositories := IndexRepositories(g)
+	repositories := make([]GiteaRepository, len(hostedRepositories))
+	forEachConcurrently(len(hostedRepositories), func(i int) {
+		repo := GiteaRepository{HostedRepository: hostedRepositories[i]}
+		releases, err := g.LoadReleases(repo.FullName)
+		if err != nil {
+			fmt.Printf("  ! Cannot get releases of %s: %v\n", repo.FullName, err)
+		}
+		repo.Releases = releases
+		repositories[i] = repo
+	})
+	newRepos := NewRepositories(g.HostedRepositories(), hostedRepositories)
+	if len(newRepos) > 0 {
+		g.notificationModule.AddNotification(RepositoryNotification("New gitea repositories found", g.httpUrl+"/assets/img/logo.png", newRepos))
+	}
+	g.repositories = repositories
+}
+
+func (g *GiteaModule) apiUrl(path string) string {
+	return g.httpUrl + "/api/v1/" + path
+}
+
+// ListRepositories lists the repositories of the user and of all
+// organizations the user belongs to.
+func (g *GiteaModule) ListRepositories() ([]HostedRepository, error) {
+	var organizations []giteaOwner
+	if err := g.getPages(g.apiUrl("user/orgs"), func(body []byte) (int, error) {
+		var page []giteaOwner
+		err := json.Unmarshal(body, &page)
+		organizations = append(organizations, page...)
+		return len(page), err
+	}); err != nil {
+		return nil, fmt.Errorf("cannot list organizations: %v", err)
+	}
+
+	listings := []string{g.apiUrl("user/repos")}
+	for _, organization := range organizations {
+		listings = append(listings, g.apiUrl("orgs/"+url.PathEscape(organization.Login)+"/repos"))
+	}
+	var host string
+	if parsedUrl, err := url.Parse(g.httpUrl); err == nil {
+		host = parsedUrl.Hostname()
+	}
+	var repositories []HostedRepository
+	found := make(map[string]bool)
+	for _, listing := range listings {
+		err := g.getPages(listing, func(body []byte) (int, error) {
+			var page []giteaRepository
+			if err := json.Unmarshal(body, &page); err != nil {
+				return 0, err
+			}
+			for _, repository := range page {
+				if !found[repository.FullName] {
+					found[repository.FullName] = true
+					repositories = append(repositories, hostedGiteaRepository(host, repository))
+				}
+			}
+			return len(page), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return repositories, nil
+}
+
+func hostedGiteaRepository(host string, repository giteaRepository) HostedRepository {
+	project := repository.Owner.FullName
+	if project == "" {
+		project = repository.Owner.Login
+	}
+	defaultBranch := repository.DefaultBranch
+	if repository.Empty {
+		defaultBranch = ""
+	}
+	return HostedRepository{
+		Name:          repository.Name,
+		FullName:      repository.FullName,
+		Project:       project,
+		ProjectKey:    repository.Owner.Login,
+		Slug:          repository.Name,
+		DefaultBranch: defaultBranch,
+		WebUrl:        repository.HtmlUrl,
+		CloneLinks: []CloneLink{
+			{Name: "ssh", Href: repository.SshUrl},
+			{Name: "https", Href: repository.CloneUrl},
+		},
+		Host:      host,
+		Workspace: repository.Owner.Login,
+		UpdatedOn: repository.UpdatedAt,
+		Topics:    repository.Topics,
+	}
+}
+
+// GetReadmeText uses the contents endpoint, which lists the root directory
+// in a single response.
+func (g *GiteaModule) GetReadmeText(repository HostedRepository) (string, error) {
+	if repository.DefaultBranch == "" {
+		return "", nil
+	}
+	repositoryUrl := g.apiUrl("repos/" + repository.FullName)
+	ref := url.QueryEscape(repository.DefaultBranch)
+	var contents []giteaContent
+	if _, err := g.api.GetJson(repositoryUrl+"/contents?ref="+ref, &contents); err != nil {
+		return "", err
+	}
+	var fileNames []string
+	for _, content := range contents {
+		if content.Type == "file" {
+			fileNames = append(fileNames, content.Name)
+		}
+	}
+	readme := selectReadme(fileNames)
+	if readme == "" {
+		return "", nil
+	}
+	response, err := g.api.Get(repositoryUrl+"/raw/"+url.PathEscape(readme)+"?ref="+ref, readmeDownloadLimit(g.readmeMaxSize))
+	if err != nil {
+		return "", err
+	}
+	return cleanReadme(string(response.Body), g.readmeMaxSize), nil
+}
+
+// LoadReleases returns the latest published releases of a repository
+func (g *GiteaModule) LoadReleases(fullName string) ([]GiteaRelease, error) {
+	var releases []GiteaRelease
+	releasesUrl := fmt.Sprintf("%s?draft=false&limit=%d", g.apiUrl("repos/"+fullName+"/releases"), giteaReleaseLimit)
+	if _, err := g.api.GetJson(releasesUrl, &releases); err != nil {
+		return nil, err
+	}
+	return releases, nil
+}
+
+// getPages requests all pages of a listing. addValues parses a page and
+// returns the number of values on it.
+func (g *GiteaModule) getPages(listingUrl string, addValues func(body []byte) (int, error)) error {
+	separator := "?"
+	if strings.Contains(listingUrl, "?") {
+		separator = "&"
+	}
+	pageUrl := listingUrl + separator + "limit=50"
+	for pageUrl != "" {
+		var body json.RawMessage
+		response, err := g.api.GetJson(pageUrl, &body)
+		if err != nil {
+			return err
+		}
+		numValues, err := addValues(body)
+		if err != nil {
+			return err
+		}
+		if numValues == 0 {
+			return nil
+		}
+		pageUrl = response.Next()
+	}
+	return nil
+}
+
+func (g *GiteaModule) HostedRepositories() []HostedRepository {
+	var repositories []HostedRepository
+	for _, repo := range g.repositories {
+		repositories = append(repositories, repo.HostedRepository)
+	}
+	return repositories
+}
+
+func (g *GiteaModule) WriteExternalData(file *os.File) {
+	writeRepositoryCache(file, g.repositories)
+}
+
+func (g *GiteaModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &g.repositories)
+}
+
+type GiteaReleaseAction struct {
+	repo    GiteaRepository
+	release GiteaRelease
+}
+
+func (g GiteaReleaseAction) GetLabel() string {
+	label := "[gitea[] RELEASE " + g.repo.Name + " " + g.release.TagName
+	if g.release.Name != "" && g.release.Name != g.release.TagName {
+		label += " " + g.release.Name
+	}
+	return label
+}
+
+func (g GiteaReleaseAction) Run() string {
+	if err := launchUrl(g.release.HtmlUrl); err != nil {
+		log.Fatalf("Could not browse %s: %v", g.release.HtmlUrl, err)
+	}
+	return "Opened " + g.release.HtmlUrl
+}
+
+func (g *GiteaModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	for _, repo := range g.repositories {
+		actions = append(actions, CreateRepositoryActions(g, repo.HostedRepository, tags, []string{repo.ProjectKey})...)
+		for _, release := range repo.Releases {
+			strs := []string{"gitea", "forgejo", "release", repo.Name, repo.Project, repo.ProjectKey, release.TagName, release.Name}
+			if release.Prerelease {
+				strs = append(strs, "prerelease")
+			}
+			if DoMatch(strs, tags) {
+				actions = append(actions, GiteaReleaseAction{repo: repo, release: release})
+			}
+		}
+	}
+	return actions
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// giteaMaxPageSize mimics MAX_RESPONSE_ITEMS of gitea, which caps the limit we
+// ask for
+const giteaMaxPageSize = 2
+
+func giteaTestRepository(owner string, name string, defaultBranch string) giteaRepository {
+	return giteaRepository{
+		Name:          name,
+		FullName:      owner + "/" + name,
+		HtmlUrl:       "https://gitea.example.com/" + owner + "/" + name,
+		SshUrl:        "git@gitea.example.com:" + owner + "/" + name + ".git",
+		CloneUrl:      "https://gitea.example.com/" + owner + "/" + name + ".git",
+		DefaultBranch: defaultBranch,
+		Empty:         defaultBranch == "",
+		Owner:         giteaOwner{Login: owner},
+	}
+}
+
+// newGiteaTestServer is a stand-in for the gitea api. It counts the requests
+// per path.
+func newGiteaTestServer(t *testing.T, requests map[string]int) *httptest.Server {
+	listings := map[string]interface{}{
+		"/api/v1/user/orgs": []giteaOwner{
+			{Login: "acme", FullName: "Acme Corp"},
+			{Login: "ops"},
+			{Login: "tools"},
+		},
+		"/api/v1/user/repos": []giteaRepository{
+			giteaTestRepository("jdoe", "dotfiles", "main"),
+			// Also listed for the organization
+			giteaTestRepository("ops", "deploy", "main"),
+		},
+		"/api/v1/orgs/acme/repos": []giteaRepository{},
+		"/api/v1/orgs/ops/repos": []giteaRepository{
+			giteaTestRepository("ops", "deploy", "main"),
+			giteaTestRepository("ops", "terraform", "develop"),
+			giteaTestRepository("ops", "scratch", ""),
+		},
+		"/api/v1/orgs/tools/repos": []giteaRepository{},
+	}
+	responses := map[string]interface{}{
+		"/api/v1/repos/ops/deploy/contents?ref=main": []giteaContent{
+			{Name: "docs", Type: "dir"},
+			{Name: "README.txt", Type: "file"},
+			{Name: "README.md", Type: "file"},
+		},
+		"/api/v1/repos/ops/deploy/raw/README.md?ref=main": "# Deploy\n\nSee the [playbooks](https://wiki.example.com/playbooks).",
+		"/api/v1/repos/ops/terraform/contents?ref=develop": []giteaContent{
+			{Name: "main.tf", Type: "file"},
+			{Name: "readme.md", Type: "symlink"},
+		},
+		"/api/v1/repos/ops/deploy/releases?draft=false&limit=10": []GiteaRelease{
+			{Name: "v1.1.0", TagName: "v1.1.0", HtmlUrl: "https://gitea.example.com/ops/deploy/releases/tag/v1.1.0", PublishedAt: "2020-12-01T10:00:00Z"},
+			{Name: "v1.1.0-rc1", TagName: "v1.1.0-rc1", HtmlUrl: "https://gitea.example.com/ops/deploy/releases/tag/v1.1.0-rc1", PublishedAt: "2020-11-20T10:00:00Z", Prerelease: true},
+		},
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		if r.Header.Get("Authorization") != "token s3cr3t" {
+			t.Errorf("%s: missing token, got Authorization %q", r.URL, r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if listing, ok := listings[r.URL.Path]; ok {
+			values := reflect.ValueOf(listing)
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			if limit <= 0 || limit > giteaMaxPageSize {
+				limit = giteaMaxPageSize
+			}
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			if page < 1 {
+				page = 1
+			}
+			start := (page - 1) * limit
+			end := start + limit
+			if start > values.Len() {
+				start = values.Len()
+			}
+			if end > values.Len() {
+				end = values.Len()
+			}
+			if end < values.Len() {
+				next := fmt.Sprintf("%s%s?limit=%d&page=%d", server.URL, r.URL.Path, limit, page+1)
+				w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(values.Slice(start, end).Interface())
+			return
+		}
+		response, ok := responses[r.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if text, ok := response.(string); ok {
+			_, _ = w.Write([]byte(text))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	return server
+}
+
+func newGiteaTestModule(t *testing.T, requests map[string]int) (*httptest.Server, *GiteaModule) {
+	server := newGiteaTestServer(t, requests)
+	viper.Set("Gitea.http-url", server.URL+"/")
+	viper.Set("Gitea.token", "s3cr3t")
+	module := NewGiteaModule(nil)
+	module.UpdateSettings()
+	return server, module
+}
+
+func TestGiteaListRepositories(t *testing.T) {
+	requests := map[string]int{}
+	server, module := newGiteaTestModule(t, requests)
+	defer server.Close()
+
+	repositories, err := module.ListRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fullNames []string
+	for _, repository := range repositories {
+		fullNames = append(fullNames, repository.FullName)
+	}
+	want := []string{"jdoe/dotfiles", "ops/deploy", "ops/terraform", "ops/scratch"}
+	if !reflect.DeepEqual(fullNames, want) {
+		t.Errorf("ListRepositories() = %v, want %v", fullNames, want)
+	}
+	// Three organizations on two pages, three repositories of ops on two pages
+	if requests["/api/v1/user/orgs"] != 2 {
+		t.Errorf("requested %d pages of organizations, want 2", requests["/api/v1/user/orgs"])
+	}
+	if requests["/api/v1/orgs/ops/repos"] != 2 {
+		t.Errorf("requested %d pages of repositories of ops, want 2", requests["/api/v1/orgs/ops/repos"])
+	}
+
+	deploy := repositories[1]
+	wantDeploy := HostedRepository{
+		Name:          "deploy",
+		FullName:      "ops/deploy",
+		Project:       "ops",
+		ProjectKey:    "ops",
+		Slug:          "deploy",
+		DefaultBranch: "main",
+		WebUrl:        "https://gitea.example.com/ops/deploy",
+		CloneLinks: []CloneLink{
+			{Name: "ssh", Href: "git@gitea.example.com:ops/deploy.git"},
+			{Name: "https", Href: "https://gitea.example.com/ops/deploy.git"},
+		},
+		Host:      "127.0.0.1",
+		Workspace: "ops",
+	}
+	if !reflect.DeepEqual(deploy, wantDeploy) {
+		t.Errorf("ListRepositories()[1] = %+v, want %+v", deploy, wantDeploy)
+	}
+	if repositories[3].DefaultBranch != "" {
+		t.Errorf("empty repository has default branch %q", repositories[3].DefaultBranch)
+	}
+}
+
+func TestGiteaGetReadmeText(t *testing.T) {
+	requests := map[string]int{}
+	server, module := newGiteaTestModule(t, requests)
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		fullName      string
+		defaultBranch string
+		want          string
+	}{
+		{"markdown preferred", "ops/deploy", "main", "# Deploy\n\nSee the playbooks."},
+		{"symlinks are no README", "ops/terraform", "develop", ""},
+		{"empty repository", "ops/scratch", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			readme, err := module.GetReadmeText(HostedRepository{FullName: test.fullName, DefaultBranch: test.defaultBranch})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if readme != test.want {
+				t.Errorf("GetReadmeText() = %q, want %q", readme, test.want)
+			}
+		})
+	}
+	if requests["/api/v1/repos/ops/scratch/contents"] != 0 {
+		t.Errorf("requested the contents of an empty repository")
+	}
+}
+
+func TestGiteaLoadReleases(t *testing.T) {
+	requests := map[string]int{}
+	server, module := newGiteaTestModule(t, requests)
+	defer server.Close()
+
+	releases, err := module.LoadReleases("ops/deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 2 || releases[0].TagName != "v1.1.0" || !releases[1].Prerelease {
+		t.Errorf("LoadReleases() = %+v", releases)
+	}
+
+	if _, err := module.LoadReleases("ops/unknown"); err == nil {
+		t.Errorf("LoadReleases() of an unknown repository should fail")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// NewHttpClient creates a http client with the tls settings from the config
+// section of a module:
+//
+//   - `verify-tls`: set to false to accept any certificate (default true)
+//   - `ca-file`: pem file with additional trusted certificates, eg. the ones of
+//     a company CA
+func NewHttpClient(moduleName string) *http.Client {
+	tlsConfig := &tls.Config{}
+	configKey := moduleName + ".verify-tls"
+	if viper.IsSet(configKey) && !viper.GetBool(configKey) {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	configKey = moduleName + ".ca-file"
+	if viper.IsSet(configKey) {
+		caFile := viper.GetString(configKey)
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			log.Fatalf("Cannot read `%s` %s: %v", configKey, caFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in `%s` %s", configKey, caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}
+}
+
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// nextLink returns the url of the next page from a `Link` header as sent by
+// eg. github, gitlab and gitea, or "" on the last page.
+func nextLink(header http.Header) string {
+	match := nextLinkPattern.FindStringSubmatch(header.Get("Link"))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// ApiClient sends requests to the http api of a module. It adds the
+// credentials to every request and treats any status outside of 2xx as error.
+type ApiClient struct {
+	client *http.Client
+	auth   func(req *http.Request)
+}
+
+// NewApiClient creates an api client with the tls settings of the module.
+// auth sets the credentials on a request and can be nil.
+func NewApiClient(moduleName string, auth func(req *http.Request)) *ApiClient {
+	return &ApiClient{client: NewHttpClient(moduleName), auth: auth}
+}
+
+// BearerAuth sends the token in the Authorization header
+func BearerAuth(token string) func(req *http.Request) {
+	return HeaderAuth("Authorization", "Bearer "+token)
+}
+
+// BasicAuth sends username and password with basic authentication
+func BasicAuth(username string, password string) func(req *http.Request) {
+	return func(req *http.Request) {
+		req.SetBasicAuth(username, password)
+	}
+}
+
+// BasicOrBearerAuth uses basic authentication if a username is set and sends
+// the token as bearer token otherwise, as cloud and data center versions of
+// the atlassian products expect.
+func BasicOrBearerAuth(username string, token string) func(req *http.Request) {
+	if username != "" {
+		return BasicAuth(username, token)
+	}
+	return BearerAuth(token)
+}
+
+// HeaderAuth sends the credentials in a header, eg. `PRIVATE-TOKEN` for
+// gitlab
+func HeaderAuth(name string, value string) func(req *http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set(name, value)
+	}
+}
+
+// ApiResponse is a response that was read completely
+type ApiResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Next returns the url of the next page from the `Link` header or "" on the
+// last page.
+func (r ApiResponse) Next() string {
+	return nextLink(r.Header)
+}
+
+// HttpStatusError is returned for responses outside of the 2xx range
+type HttpStatusError struct {
+	Method     string
+	Url        string
+	StatusCode int
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("%s %s failed (HTTP %v)", e.Method, e.Url, e.StatusCode)
+}
+
+// Open sends the request and returns the response, so the body can be
+// streamed. The caller closes the body with closeResponseBody.
+func (a *ApiClient) Open(req *http.Request) (*http.Response, error) {
+	if a.auth != nil {
+		a.auth(req)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		closeResponseBody(resp)
+		return resp, &HttpStatusError{Method: req.Method, Url: req.URL.String(), StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// Do sends the request and returns the first limit bytes of the response or
+// everything if limit is negative. The status and header are set on errors
+// of the status, too.
+func (a *ApiClient) Do(req *http.Request, limit int64) (ApiResponse, error) {
+	resp, err := a.Open(req)
+	if resp == nil {
+		return ApiResponse{}, err
+	}
+	response := ApiResponse{StatusCode: resp.StatusCode, Header: resp.Header}
+	if err != nil {
+		return response, err
+	}
+	defer closeResponseBody(resp)
+	var body io.Reader = resp.Body
+	if limit >= 0 {
+		body = io.LimitReader(resp.Body, limit)
+	}
+	response.Body, err = ioutil.ReadAll(body)
+	return response, err
+}
+
+// Get returns the first limit bytes of the response or everything if limit is
+// negative.
+func (a *ApiClient) Get(url string, limit int64) (ApiResponse, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return ApiResponse{}, err
+	}
+	return a.Do(req, limit)
+}
+
+// GetJson decodes the response into target. The response is returned for the
+// pagination headers.
+func (a *ApiClient) GetJson(url string, target interface{}) (ApiResponse, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return ApiResponse{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	response, err := a.Do(req, -1)
+	if err != nil {
+		return response, err
+	}
+	return response, json.Unmarshal(response.Body, target)
+}
+
+// SendJson sends body as json and decodes the response into target. Both body
+// and target can be nil.
+func (a *ApiClient) SendJson(method string, url string, body interface{}, target interface{}) error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+	req, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	response, err := a.Do(req, -1)
+	if err != nil || target == nil {
+		return err
+	}
+	return json.Unmarshal(response.Body, target)
+}
+
+func closeResponseBody(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		log.Fatalf("Could not close response body: %v", err)
+	}
+}
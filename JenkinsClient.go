@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+)
+
+// JenkinsClient talks to the parts of the jenkins api that the jenkins-api
+// library does not cover.
+type JenkinsClient struct {
+	httpUrl  string
+	username string
+	token    string
+	client   *http.Client
+	// Jenkins does not need a crumb for requests authenticated by api token,
+	// so the crumb is only fetched after the first POST got rejected.
+	crumb        *jenkinsCrumb
+	crumbFetched bool
+}
+
+type jenkinsCrumb struct {
+	Crumb             string `json:"crumb"`
+	CrumbRequestField string `json:"crumbRequestField"`
+}
+
+func NewJenkinsClient(httpUrl string, username string, token string) *JenkinsClient {
+	// Crumbs are bound to the web session, so we need to keep the cookies
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		log.Fatalf("Cannot create cookie jar: %v", err)
+	}
+	return &JenkinsClient{
+		httpUrl:  httpUrl,
+		username: username,
+		token:    token,
+		client: &http.Client{
+			Jar: jar,
+			// Jenkins answers some POSTs (eg. `stop`) with a redirect, which
+			// we want to see as is.
+			CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// jenkinsUrl joins a jenkins object url (which usually ends with a slash) and
+// a relative path.
+func jenkinsUrl(base string, path string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+func (c *JenkinsClient) getJson(url string, target interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Fatalf("Could not close response body: %v", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s failed (HTTP %v)", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// post sends a form to jenkins. The permission is only used to explain a
+// rejected request, eg. "Job/Build".
+func (c *JenkinsClient) post(url string, params url.Values, permission string) error {
+	_, err := c.postForLocation(url, params, permission)
+	return err
+}
+
+// postForLocation is post, but returns the location jenkins answered with, eg.
+// the queue item of a started build.
+func (c *JenkinsClient) postForLocation(url string, params url.Values, permission string) (string, error) {
+	statusCode, location, err := c.doPost(url, params)
+	if err != nil {
+		return "", err
+	}
+	if statusCode == http.StatusForbidden && !c.crumbFetched {
+		if err := c.fetchCrumb(); err != nil {
+			return "", err
+		}
+		if c.crumb != nil {
+			statusCode, location, err = c.doPost(url, params)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	switch statusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusFound:
+		return location, nil
+	case http.StatusUnauthorized:
+		return "", fmt.Errorf("jenkins did not accept the credentials of %s (HTTP %v). Please check the configured username and api token", c.username, statusCode)
+	case http.StatusForbidden:
+		return "", fmt.Errorf("jenkins denied the request (HTTP %v). Most likely %s lacks the %s permission for this job", statusCode, c.username, permission)
+	default:
+		return "", fmt.Errorf("POST %s failed (HTTP %v)", url, statusCode)
+	}
+}
+
+func (c *JenkinsClient) doPost(url string, params url.Values) (int, string, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(params.Encode()))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.username, c.token)
+	if c.crumb != nil {
+		req.Header.Set(c.crumb.CrumbRequestField, c.crumb.Crumb)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Fatalf("Could not close response body: %v", err)
+	}
+	return resp.StatusCode, resp.Header.Get("Location"), nil
+}
+
+// fetchCrumb gets a crumb from the crumb issuer. If jenkins has no crumb
+// issuer (ie. CSRF protection is disabled), the crumb stays empty.
+func (c *JenkinsClient) fetchCrumb() error {
+	c.crumbFetched = true
+	crumbUrl := jenkinsUrl(c.httpUrl, "crumbIssuer/api/json")
+	req, err := http.NewRequest("GET", crumbUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Fatalf("Could not close response body: %v", err)
+		}
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not get crumb from %s (HTTP %v)", crumbUrl, resp.StatusCode)
+	}
+	crumb := new(jenkinsCrumb)
+	if err := json.NewDecoder(resp.Body).Decode(crumb); err != nil {
+		return fmt.Errorf("could not parse crumb from %s: %v", crumbUrl, err)
+	}
+	c.crumb = crumb
+	return nil
+}
@@ -5,20 +5,67 @@ import (
 	"fmt"
 	. "github.com/Medisafe/jenkins-api/jenkins"
 	"github.com/spf13/viper"
+	"io/ioutil"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type JenkinsModule struct {
-	httpUrl            string
-	username           string
-	token              string
-	jobs               []Job
+	instances          []*JenkinsInstance
 	notificationModule *DelegatingNotificationsModule
 }
 
+// JenkinsInstance is a single jenkins installation. Each instance has its own
+// credentials and job cache.
+type JenkinsInstance struct {
+	name     string
+	label    string
+	httpUrl  string
+	username string
+	token    string
+	client   *JenkinsClient
+	jobs     []JenkinsJob
+	// cached is set if the jobs were read from the cache. Without it, we
+	// cannot tell which jobs are new or changed.
+	cached bool
+	// watch selects the jobs that get state change notifications
+	watch      []Tag
+	staleAfter time.Duration
+}
+
+// JenkinsJob holds the job details we need. We do not use Job from the
+// jenkins-api library here, because it cannot map the color of a job.
+type JenkinsJob struct {
+	Class               string `json:"_class"`
+	Name                string `json:"name"`
+	DisplayName         string `json:"displayName"`
+	Description         string `json:"description"`
+	Url                 string `json:"url"`
+	Buildable           bool   `json:"buildable"`
+	Color               string `json:"color"`
+	InQueue             bool   `json:"inQueue"`
+	LastBuild           Build  `json:"lastBuild"`
+	LastCompletedBuild  Build  `json:"lastCompletedBuild"`
+	LastFailedBuild     Build  `json:"lastFailedBuild"`
+	LastSuccessfulBuild Build  `json:"lastSuccessfulBuild"`
+	NextBuildNumber     int    `json:"nextBuildNumber"`
+	// Stale is set if the last successful build is older than the configured
+	// threshold.
+	Stale bool `json:"stale"`
+}
+
+type jenkinsInstanceSettings struct {
+	Name     string `mapstructure:"name"`
+	HttpUrl  string `mapstructure:"http-url"`
+	Username string `mapstructure:"username"`
+	Token    string `mapstructure:"token"`
+}
+
 func NewJenkinsModule(notifications *DelegatingNotificationsModule) *JenkinsModule {
 	j := new(JenkinsModule)
 	j.notificationModule = notifications
@@ -38,23 +85,68 @@ func (j *JenkinsModule) CanBeDisabled() bool {
 }
 
 func (j *JenkinsModule) UpdateSettings() {
-	configKey := j.Name() + ".http-url"
-	if !viper.IsSet(configKey) {
-		log.Fatalf("Missing configuration key `%s` (eg. 'https://jenkins.example.com')", configKey)
+	var settings []jenkinsInstanceSettings
+	configKey := j.Name() + ".instances"
+	if viper.IsSet(configKey) {
+		if err := viper.UnmarshalKey(configKey, &settings); err != nil {
+			log.Fatalf("Invalid configuration key `%s`: %v", configKey, err)
+		}
+		for i, instance := range settings {
+			if instance.Name == "" || instance.HttpUrl == "" || instance.Username == "" || instance.Token == "" {
+				log.Fatalf("Configuration key `%s` #%d needs `name`, `http-url`, `username` and `token`", configKey, i+1)
+			}
+		}
+	} else {
+		// Single instance configuration
+		instance := jenkinsInstanceSettings{Name: "default"}
+		configKey = j.Name() + ".http-url"
+		if !viper.IsSet(configKey) {
+			log.Fatalf("Missing configuration key `%s` (eg. 'https://jenkins.example.com')", configKey)
+		}
+		instance.HttpUrl = viper.GetString(configKey)
+
+		configKey = j.Name() + ".username"
+		if !viper.IsSet(configKey) {
+			log.Fatalf("Missing configuration key `%s` (eg. 'myusername')", configKey)
+		}
+		instance.Username = viper.GetString(configKey)
+
+		configKey = j.Name() + ".token"
+		if !viper.IsSet(configKey) {
+			log.Fatalf("Missing configuration key `%s` (eg. 'mytoken')", configKey)
+		}
+		instance.Token = viper.GetString(configKey)
+		settings = append(settings, instance)
 	}
-	j.httpUrl = viper.GetString(configKey)
 
-	configKey = j.Name() + ".username"
-	if !viper.IsSet(configKey) {
-		log.Fatalf("Missing configuration key `%s` (eg. 'myusername')", configKey)
+	var watch []Tag
+	configKey = j.Name() + ".watch"
+	if viper.IsSet(configKey) {
+		watch = TagsFromStrings(viper.GetStringSlice(configKey))
+	}
+	var staleAfter time.Duration
+	configKey = j.Name() + ".stale-after-days"
+	if viper.IsSet(configKey) {
+		staleAfter = time.Duration(viper.GetInt(configKey)) * 24 * time.Hour
 	}
-	j.username = viper.GetString(configKey)
 
-	configKey = j.Name() + ".token"
-	if !viper.IsSet(configKey) {
-		log.Fatalf("Missing configuration key `%s` (eg. 'mytoken')", configKey)
+	j.instances = nil
+	for _, instanceSettings := range settings {
+		label := "[jenkins[]"
+		if len(settings) > 1 {
+			label = "[jenkins/" + instanceSettings.Name + "[]"
+		}
+		j.instances = append(j.instances, &JenkinsInstance{
+			name:       instanceSettings.Name,
+			label:      label,
+			httpUrl:    instanceSettings.HttpUrl,
+			username:   instanceSettings.Username,
+			token:      instanceSettings.Token,
+			client:     NewJenkinsClient(instanceSettings.HttpUrl, instanceSettings.Username, instanceSettings.Token),
+			watch:      watch,
+			staleAfter: staleAfter,
+		})
 	}
-	j.token = viper.GetString(configKey)
 }
 
 func (j *JenkinsModule) NeedsExternalData() bool {
@@ -62,32 +154,66 @@ func (j *JenkinsModule) NeedsExternalData() bool {
 }
 
 func (j *JenkinsModule) UpdateExternalData() {
+	for _, instance := range j.instances {
+		previousJobs := instance.jobs
+		newJobs := instance.UpdateJobs()
+		if !instance.cached {
+			// The first update, so every job would count as new
+			instance.cached = true
+			fmt.Printf("  - Found %d jobs on %s\n", len(instance.jobs), instance.name)
+			continue
+		}
+		if len(newJobs) > 0 {
+			j.notificationModule.AddNotification(prepareJenkinsNotification(instance, newJobs))
+		}
+		if changes := instance.WatchedChanges(previousJobs); changes != "" {
+			j.notificationModule.AddNotification(Notification{
+				Title:   "Jenkins jobs changed on " + instance.name,
+				Text:    changes,
+				IconUrl: "https://raw.githubusercontent.com/sne11ius/furbnicator/main/jenkins-logo.jpeg",
+			})
+		}
+		fmt.Printf("  - Updated %d jobs on %s\n", len(instance.jobs), instance.name)
+	}
+}
+
+// UpdateJobs loads all jobs of the instance and returns the ones that were not
+// known before.
+func (i *JenkinsInstance) UpdateJobs() []JenkinsJob {
 	jenkinsApi := Init(&Connection{
-		Username:    j.username,
-		AccessToken: j.token,
-		BaseUrl:     j.httpUrl,
+		Username:    i.username,
+		AccessToken: i.token,
+		BaseUrl:     i.httpUrl,
 	})
 	jobs, err := jenkinsApi.GetJobs()
 	if err != nil {
-		log.Fatalf("Cannot list Jenkins Jobs: %s", err)
+		log.Fatalf("Cannot list Jenkins Jobs on %s: %s", i.name, err)
 	}
 	numJobs := len(jobs)
 
 	// From https://stackoverflow.com/a/39065381
 	var wg sync.WaitGroup
 	wg.Add(numJobs)
-	queue := make(chan Job, 1)
-	for i := 0; i < numJobs; i++ {
-		go func(i int) {
-			job := jobs[i]
-			details, err := jenkinsApi.GetJob(job.Name)
-			if err != nil {
-				log.Fatalf("Cannot get job detail for %s", job.Name)
+	queue := make(chan JenkinsJob, 1)
+	for n := 0; n < numJobs; n++ {
+		go func(n int) {
+			job := jobs[n]
+			var details JenkinsJob
+			if err := i.client.getJson(jenkinsUrl(job.Url, "api/json"), &details); err != nil {
+				log.Fatalf("Cannot get job detail for %s on %s: %v", job.Name, i.name, err)
+			}
+			if i.staleAfter > 0 && i.isWatched(details) && details.LastSuccessfulBuild.Number != 0 {
+				var build Build
+				if err := i.client.getJson(jenkinsUrl(job.Url, "lastSuccessfulBuild/api/json"), &build); err != nil {
+					log.Fatalf("Cannot get last successful build for %s on %s: %v", job.Name, i.name, err)
+				}
+				details.LastSuccessfulBuild = build
+				details.Stale = i.isStale(build, time.Now())
 			}
-			queue <- *details
-		}(i)
+			queue <- details
+		}(n)
 	}
-	var allJobDetails []Job
+	var allJobDetails []JenkinsJob
 	go func() {
 		for t := range queue {
 			allJobDetails = append(allJobDetails, t)
@@ -96,64 +222,186 @@ func (j *JenkinsModule) UpdateExternalData() {
 	}()
 	wg.Wait()
 
-	var newJobDetails []Job
+	var newJobDetails []JenkinsJob
 	for _, job := range allJobDetails {
-		found := false
-		for _, existingJob := range j.jobs {
-			if job.Name == existingJob.Name {
-				found = true
-				break
-			}
-		}
-		if !found {
+		if findJenkinsJob(i.jobs, job.Name) == nil {
 			newJobDetails = append(newJobDetails, job)
 		}
 	}
 
-	if len(newJobDetails) > 0 {
-		j.notificationModule.AddNotification(prepareJenkinsNotification(newJobDetails))
+	i.jobs = allJobDetails
+	return newJobDetails
+}
+
+func findJenkinsJob(jobs []JenkinsJob, name string) *JenkinsJob {
+	for n := range jobs {
+		if jobs[n].Name == name {
+			return &jobs[n]
+		}
+	}
+	return nil
+}
+
+func (i *JenkinsInstance) isWatched(job JenkinsJob) bool {
+	for _, tag := range i.watch {
+		if tag.Matches(job.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStale tells if the last successful build is older than the configured
+// threshold at the given time.
+func (i *JenkinsInstance) isStale(lastSuccessfulBuild Build, now time.Time) bool {
+	if i.staleAfter <= 0 || lastSuccessfulBuild.Number == 0 {
+		return false
 	}
+	lastSuccess := time.Unix(0, lastSuccessfulBuild.Timestamp*int64(time.Millisecond))
+	return now.Sub(lastSuccess) > i.staleAfter
+}
 
-	j.jobs = allJobDetails
-	fmt.Printf("  - Updated %d jobs\n", len(j.jobs))
+// jenkinsJobState maps the color of a job to "successful", "failing" or "" if
+// the job state is not interesting (eg. disabled or not built yet).
+func jenkinsJobState(job JenkinsJob) string {
+	switch strings.TrimSuffix(job.Color, "_anime") {
+	case "blue":
+		return "successful"
+	case "red", "yellow":
+		return "failing"
+	default:
+		return ""
+	}
 }
 
-func prepareJenkinsNotification(newJobDetails []Job) Notification {
+// WatchedChanges describes what happened to the watched jobs since the
+// previous update as markdown list.
+func (i *JenkinsInstance) WatchedChanges(previousJobs []JenkinsJob) string {
+	text := ""
+	for _, job := range i.jobs {
+		previous := findJenkinsJob(previousJobs, job.Name)
+		if previous == nil || !i.isWatched(job) {
+			continue
+		}
+		state := jenkinsJobState(job)
+		previousState := jenkinsJobState(*previous)
+		if state != "" && previousState != "" && state != previousState {
+			text = text + "- [" + job.Name + "](" + job.Url + ") is " + state + " (was " + previousState + ")\\n"
+		}
+		if job.Stale && !previous.Stale {
+			days := int(i.staleAfter.Hours() / 24)
+			text = text + "- [" + job.Name + "](" + job.Url + ") has no successful build for more than " + strconv.Itoa(days) + " days\\n"
+		}
+	}
+	for _, previous := range previousJobs {
+		if findJenkinsJob(i.jobs, previous.Name) == nil && i.isWatched(previous) {
+			text = text + "- " + previous.Name + " was deleted\\n"
+		}
+	}
+	return text
+}
+
+func prepareJenkinsNotification(instance *JenkinsInstance, newJobDetails []JenkinsJob) Notification {
 	text := ""
 	for _, job := range newJobDetails {
 		text = text + "- [" + job.Name + "](" + job.Url + ")\\n"
 	}
 	return Notification{
-		Title:   "New jenkins jobs found",
+		Title:   "New jenkins jobs found on " + instance.name,
 		Text:    text,
 		IconUrl: "https://raw.githubusercontent.com/sne11ius/furbnicator/main/jenkins-logo.jpeg",
 	}
 }
 
+func (i *JenkinsInstance) cacheFile() string {
+	return LocateCacheFile("Jenkins-" + i.name)
+}
+
+// WriteExternalData writes the names of all instances to the module cache file.
+// The jobs of each instance go to a separate file.
 func (j *JenkinsModule) WriteExternalData(file *os.File) {
-	bytes, err := json.Marshal(j.jobs)
+	var names []string
+	for _, instance := range j.instances {
+		bytes, err := json.Marshal(instance.jobs)
+		if err != nil {
+			log.Fatalf("Cannot serialize job data of %s: %s", instance.name, err)
+		}
+		filename := instance.cacheFile()
+		if err := ioutil.WriteFile(filename, bytes, 0644); err != nil {
+			log.Fatalf("Cannot write job data to %s: %s", filename, err)
+		}
+		names = append(names, instance.name)
+	}
+	bytes, err := json.Marshal(names)
 	if err != nil {
-		log.Fatalf("Cannot serialize job data: %s", err)
+		log.Fatalf("Cannot serialize jenkins instance names: %s", err)
 	}
 	if _, err = file.Write(bytes); err != nil {
-		log.Fatalf("Cannot write job data to %v: %s", file, err)
+		log.Fatalf("Cannot write jenkins instance names to %v: %s", file, err)
 	}
 }
 
+// ReadExternalData reads the jobs of each instance. Older versions cached the
+// jobs of the single instance in the module cache file, those now belong to
+// the instance named default.
 func (j *JenkinsModule) ReadExternalData(data []byte) error {
-	err := json.Unmarshal(data, &j.jobs)
-	if err != nil {
-		log.Fatalf("Cannot read jenkins job cache. Please run with `-u` parameter first.")
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
 	}
-	return nil
+	if len(entries) > 0 && strings.HasPrefix(strings.TrimSpace(string(entries[0])), "{") {
+		return j.readLegacyExternalData(data)
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+	var result error
+	for _, instance := range j.instances {
+		found := false
+		for _, name := range names {
+			if name == instance.name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = fmt.Errorf("no cached jobs for jenkins instance %s", instance.name)
+			continue
+		}
+		bytes, err := ioutil.ReadFile(instance.cacheFile())
+		if err == nil {
+			err = json.Unmarshal(bytes, &instance.jobs)
+		}
+		if err != nil {
+			result = fmt.Errorf("cannot read cached jobs for jenkins instance %s: %v", instance.name, err)
+			continue
+		}
+		instance.cached = true
+	}
+	return result
+}
+
+func (j *JenkinsModule) readLegacyExternalData(data []byte) error {
+	for _, instance := range j.instances {
+		if instance.name == "default" {
+			if err := json.Unmarshal(data, &instance.jobs); err != nil {
+				return err
+			}
+			instance.cached = true
+			return nil
+		}
+	}
+	return fmt.Errorf("no jenkins instance named default for the cached jobs")
 }
 
 type JenkinsBrowseAction struct {
-	job Job
+	instance *JenkinsInstance
+	job      JenkinsJob
 }
 
 func (j JenkinsBrowseAction) GetLabel() string {
-	return "[jenkins[] BROWSE " + j.job.Name
+	return j.instance.label + " BROWSE " + j.job.Name
 }
 
 func (j JenkinsBrowseAction) Run() string {
@@ -165,52 +413,164 @@ func (j JenkinsBrowseAction) Run() string {
 }
 
 type JenkinsRunJobAction struct {
-	job      Job
-	username string
-	token    string
+	instance *JenkinsInstance
+	job      JenkinsJob
 }
 
 func (j JenkinsRunJobAction) GetLabel() string {
-	return "[jenkins[] RUN " + j.job.Name
+	return j.instance.label + " RUN " + j.job.Name
 }
 
 func (j JenkinsRunJobAction) Run() string {
-	url := j.job.Url + "/build"
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		log.Fatalf("Could not create request to start job %s: %v", j.job.Name, err)
-	}
-	req.SetBasicAuth(j.username, j.token)
-	resp, err := client.Do(req)
+	queueItemUrl, err := j.instance.client.postForLocation(jenkinsUrl(j.job.Url, "build"), url.Values{}, "Job/Build")
 	if err != nil {
 		log.Fatalf("Could not start job %s: %v", j.job.Name, err)
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Fatalf("Could not close response body: %v", err)
+	return j.instance.followOrStarted(j.job, queueItemUrl, "Started job "+j.job.Name)
+}
+
+type JenkinsAbortAction struct {
+	instance *JenkinsInstance
+	job      JenkinsJob
+}
+
+func (j JenkinsAbortAction) GetLabel() string {
+	return j.instance.label + " ABORT " + j.job.Name
+}
+
+func (j JenkinsAbortAction) Run() string {
+	var build Build
+	if err := j.instance.client.getJson(jenkinsUrl(j.job.Url, "lastBuild/api/json"), &build); err != nil {
+		log.Fatalf("Could not get last build of job %s: %v", j.job.Name, err)
+	}
+	if !build.Building {
+		return "No running build for job " + j.job.Name
+	}
+	if !confirm(fmt.Sprintf("Abort build #%d of %s?", build.Number, j.job.Name)) {
+		return "Not aborted " + build.Url
+	}
+	if err := j.instance.client.post(jenkinsUrl(build.Url, "stop"), url.Values{}, "Job/Cancel"); err != nil {
+		log.Fatalf("Could not abort build #%d of job %s: %v", build.Number, j.job.Name, err)
+	}
+	return "Aborted " + build.Url
+}
+
+type JenkinsRebuildAction struct {
+	instance *JenkinsInstance
+	job      JenkinsJob
+}
+
+func (j JenkinsRebuildAction) GetLabel() string {
+	return j.instance.label + " REBUILD " + j.job.Name
+}
+
+func (j JenkinsRebuildAction) Run() string {
+	var build Build
+	if err := j.instance.client.getJson(jenkinsUrl(j.job.Url, "lastBuild/api/json"), &build); err != nil {
+		log.Fatalf("Could not get last build of job %s: %v", j.job.Name, err)
+	}
+	params := url.Values{}
+	parameterized := false
+	var skipped []string
+	for _, action := range build.Actions {
+		for _, param := range action.Parameters {
+			parameterized = true
+			// Jenkins does not report the values of password, file and
+			// credentials parameters. Leave them out, so the job uses its
+			// defaults instead of the string "<nil>".
+			if param.Value == nil {
+				skipped = append(skipped, param.Name)
+				continue
+			}
+			params.Set(param.Name, fmt.Sprint(param.Value))
 		}
-	}()
-	if resp.StatusCode != http.StatusCreated {
-		log.Fatalf("Could not start job %s (HTTP %v): %v", j.job.Name, resp.StatusCode, err)
 	}
-	return "Started job " + j.job.Name
+	buildUrl := jenkinsUrl(j.job.Url, "build")
+	if parameterized {
+		buildUrl = jenkinsUrl(j.job.Url, "buildWithParameters")
+	}
+	queueItemUrl, err := j.instance.client.postForLocation(buildUrl, params, "Job/Build")
+	if err != nil {
+		log.Fatalf("Could not rebuild #%d of job %s: %v", build.Number, j.job.Name, err)
+	}
+	message := fmt.Sprintf("Started job %s with the parameters of build #%d", j.job.Name, build.Number)
+	if len(skipped) > 0 {
+		message += "\nUsed the defaults for parameters without value: " + strings.Join(skipped, ", ")
+	}
+	return j.instance.followOrStarted(j.job, queueItemUrl, message)
+}
+
+// JenkinsPermalinkAction browses one of the permalinks jenkins provides for
+// each job, eg. `lastBuild/console`.
+type JenkinsPermalinkAction struct {
+	instance  *JenkinsInstance
+	job       JenkinsJob
+	verb      string
+	permalink string
+}
+
+func (j JenkinsPermalinkAction) GetLabel() string {
+	return j.instance.label + " " + j.verb + " " + j.job.Name
+}
+
+func (j JenkinsPermalinkAction) Run() string {
+	url := jenkinsUrl(j.job.Url, j.permalink)
+	if err := launchUrl(url); err != nil {
+		log.Fatalf("Could not browse %s: %v", url, err)
+	}
+	return "Opened " + url
+}
+
+var jenkinsPermalinks = []struct {
+	verb      string
+	permalink string
+}{
+	{verb: "CONSOLE", permalink: "lastBuild/console"},
+	{verb: "LAST-BUILD", permalink: "lastBuild/"},
+	{verb: "LAST-FAILED", permalink: "lastFailedBuild/"},
 }
 
 func (j *JenkinsModule) CreateActions(tags []Tag) []action {
 	var actions []action
-	for _, job := range j.jobs {
-		strs := []string{"jenkins", "browse", job.Name, job.Description}
-		if DoMatch(strs, tags) {
-			actions = append(actions, JenkinsBrowseAction{job: job})
-		}
-		strs = []string{"jenkins", "run", job.Name, job.Description}
-		if DoMatch(strs, tags) {
-			actions = append(actions, JenkinsRunJobAction{
-				job:      job,
-				username: j.username,
-				token:    j.token,
-			})
+	for _, instance := range j.instances {
+		for _, job := range instance.jobs {
+			strs := []string{"jenkins", instance.name, "browse", job.Name, job.Description}
+			if DoMatch(strs, tags) {
+				actions = append(actions, JenkinsBrowseAction{instance: instance, job: job})
+			}
+			strs = []string{"jenkins", instance.name, "run", job.Name, job.Description}
+			if DoMatch(strs, tags) {
+				actions = append(actions, JenkinsRunJobAction{instance: instance, job: job})
+			}
+			strs = []string{"jenkins", instance.name, "rebuild", job.Name, job.Description}
+			if DoMatch(strs, tags) {
+				actions = append(actions, JenkinsRebuildAction{instance: instance, job: job})
+			}
+			strs = []string{"jenkins", instance.name, "abort", job.Name, job.Description}
+			if DoMatch(strs, tags) {
+				actions = append(actions, JenkinsAbortAction{instance: instance, job: job})
+			}
+			if job.isPipeline() {
+				strs = []string{"jenkins", instance.name, "stages", "pipeline", job.Name, job.Description}
+				if DoMatch(strs, tags) {
+					actions = append(actions, JenkinsStagesAction{instance: instance, job: job})
+				}
+				strs = []string{"jenkins", instance.name, "failed-stage", "pipeline", job.Name, job.Description}
+				if DoMatch(strs, tags) {
+					actions = append(actions, JenkinsFailedStageLogAction{instance: instance, job: job})
+				}
+			}
+			for _, permalink := range jenkinsPermalinks {
+				strs = []string{"jenkins", instance.name, strings.ToLower(permalink.verb), job.Name, job.Description}
+				if DoMatch(strs, tags) {
+					actions = append(actions, JenkinsPermalinkAction{
+						instance:  instance,
+						job:       job,
+						verb:      permalink.verb,
+						permalink: permalink.permalink,
+					})
+				}
+			}
 		}
 	}
 	return actions
@@ -0,0 +1,177 @@
+package main
+
+import (
+	. "github.com/Medisafe/jenkins-api/jenkins"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJenkinsInstanceIsStale(t *testing.T) {
+	now := time.Date(2020, 12, 24, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) int64 {
+		return now.Add(-time.Duration(days)*24*time.Hour).UnixNano() / int64(time.Millisecond)
+	}
+	tests := []struct {
+		name       string
+		staleAfter time.Duration
+		build      Build
+		want       bool
+	}{
+		{"older than threshold", 7 * 24 * time.Hour, Build{Number: 3, Timestamp: daysAgo(8)}, true},
+		{"newer than threshold", 7 * 24 * time.Hour, Build{Number: 3, Timestamp: daysAgo(6)}, false},
+		{"exactly at threshold", 7 * 24 * time.Hour, Build{Number: 3, Timestamp: daysAgo(7)}, false},
+		{"never built successfully", 7 * 24 * time.Hour, Build{}, false},
+		{"threshold not configured", 0, Build{Number: 3, Timestamp: daysAgo(365)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instance := JenkinsInstance{staleAfter: test.staleAfter}
+			if got := instance.isStale(test.build, now); got != test.want {
+				t.Errorf("isStale() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestJenkinsJobState(t *testing.T) {
+	tests := []struct {
+		color string
+		want  string
+	}{
+		{"blue", "successful"},
+		{"blue_anime", "successful"},
+		{"red", "failing"},
+		{"yellow", "failing"},
+		{"red_anime", "failing"},
+		{"disabled", ""},
+		{"notbuilt", ""},
+		{"aborted", ""},
+	}
+	for _, test := range tests {
+		if got := jenkinsJobState(JenkinsJob{Color: test.color}); got != test.want {
+			t.Errorf("jenkinsJobState(%q) = %q, want %q", test.color, got, test.want)
+		}
+	}
+}
+
+func TestJenkinsInstanceWatchedChanges(t *testing.T) {
+	job := func(name string, color string, stale bool) JenkinsJob {
+		return JenkinsJob{Name: name, Url: "https://jenkins/job/" + name + "/", Color: color, Stale: stale}
+	}
+	tests := []struct {
+		name     string
+		previous []JenkinsJob
+		current  []JenkinsJob
+		want     []string
+	}{
+		{
+			name:     "no changes",
+			previous: []JenkinsJob{job("app-build", "blue", false)},
+			current:  []JenkinsJob{job("app-build", "blue_anime", false)},
+		},
+		{
+			name:     "starts failing",
+			previous: []JenkinsJob{job("app-build", "blue", false)},
+			current:  []JenkinsJob{job("app-build", "red", false)},
+			want:     []string{"- [app-build](https://jenkins/job/app-build/) is failing (was successful)"},
+		},
+		{
+			name:     "recovers",
+			previous: []JenkinsJob{job("app-build", "yellow", false)},
+			current:  []JenkinsJob{job("app-build", "blue", false)},
+			want:     []string{"- [app-build](https://jenkins/job/app-build/) is successful (was failing)"},
+		},
+		{
+			name:     "not built before",
+			previous: []JenkinsJob{job("app-build", "notbuilt", false)},
+			current:  []JenkinsJob{job("app-build", "red", false)},
+		},
+		{
+			name:     "not watched",
+			previous: []JenkinsJob{job("lib-build", "blue", false)},
+			current:  []JenkinsJob{job("lib-build", "red", false)},
+		},
+		{
+			name:    "new job",
+			current: []JenkinsJob{job("app-build", "red", false)},
+		},
+		{
+			name:     "becomes stale",
+			previous: []JenkinsJob{job("app-build", "red", false)},
+			current:  []JenkinsJob{job("app-build", "red", true)},
+			want:     []string{"- [app-build](https://jenkins/job/app-build/) has no successful build for more than 7 days"},
+		},
+		{
+			name:     "stays stale",
+			previous: []JenkinsJob{job("app-build", "red", true)},
+			current:  []JenkinsJob{job("app-build", "red", true)},
+		},
+		{
+			name:     "deleted",
+			previous: []JenkinsJob{job("app-build", "blue", false), job("lib-build", "blue", false)},
+			current:  []JenkinsJob{},
+			want:     []string{"- app-build was deleted"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instance := JenkinsInstance{
+				jobs:       test.current,
+				watch:      TagsFromStrings([]string{"app"}),
+				staleAfter: 7 * 24 * time.Hour,
+			}
+			want := ""
+			if len(test.want) > 0 {
+				want = strings.Join(test.want, "\\n") + "\\n"
+			}
+			if got := instance.WatchedChanges(test.previous); got != want {
+				t.Errorf("WatchedChanges() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestJenkinsReadLegacyExternalData(t *testing.T) {
+	legacy := []byte(`[{"name":"app-build","url":"https://jenkins.example.com/job/app-build/","color":"blue"}]`)
+	tests := []struct {
+		name       string
+		instances  []string
+		wantCached []bool
+		wantErr    bool
+	}{
+		{"single instance", []string{"default"}, []bool{true}, false},
+		{"several instances", []string{"ci", "default"}, []bool{false, true}, false},
+		{"no default instance", []string{"ci"}, []bool{false}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			j := &JenkinsModule{}
+			for _, name := range test.instances {
+				j.instances = append(j.instances, &JenkinsInstance{name: name})
+			}
+			err := j.ReadExternalData(legacy)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ReadExternalData() error = %v, wantErr %v", err, test.wantErr)
+			}
+			for n, instance := range j.instances {
+				if instance.cached != test.wantCached[n] {
+					t.Errorf("instance %s cached = %v, want %v", instance.name, instance.cached, test.wantCached[n])
+				}
+				if instance.cached && (len(instance.jobs) != 1 || instance.jobs[0].Name != "app-build" || instance.jobs[0].Color != "blue") {
+					t.Errorf("instance %s jobs = %+v", instance.name, instance.jobs)
+				}
+			}
+		})
+	}
+}
+
+func TestJenkinsReadExternalDataWithoutInstanceCache(t *testing.T) {
+	j := &JenkinsModule{instances: []*JenkinsInstance{{name: "default"}}}
+	if err := j.ReadExternalData([]byte(`["ci"]`)); err == nil {
+		t.Errorf("ReadExternalData() should fail without cached jobs")
+	}
+	if j.instances[0].cached {
+		t.Errorf("instance without cached jobs is marked as cached")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const jenkinsPipelineClass = "org.jenkinsci.plugins.workflow.job.WorkflowJob"
+
+// jenkinsFollowInterval is how often we ask jenkins about a followed build
+var jenkinsFollowInterval = 5 * time.Second
+
+// Models for the responses of the pipeline stage view plugin (wfapi)
+type jenkinsPipelineRun struct {
+	Id             string                 `json:"id"`
+	Name           string                 `json:"name"`
+	Status         string                 `json:"status"`
+	DurationMillis int64                  `json:"durationMillis"`
+	Stages         []jenkinsPipelineStage `json:"stages"`
+}
+
+type jenkinsPipelineStage struct {
+	Id             string                    `json:"id"`
+	Name           string                    `json:"name"`
+	Status         string                    `json:"status"`
+	DurationMillis int64                     `json:"durationMillis"`
+	StageFlowNodes []jenkinsPipelineFlowNode `json:"stageFlowNodes"`
+}
+
+type jenkinsPipelineFlowNode struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// jenkinsQueueItem is a build waiting for an executor. Executable is set once
+// the build started.
+type jenkinsQueueItem struct {
+	Cancelled  bool `json:"cancelled"`
+	Executable *struct {
+		Number int    `json:"number"`
+		Url    string `json:"url"`
+	} `json:"executable"`
+}
+
+func (j JenkinsJob) isPipeline() bool {
+	return j.Class == jenkinsPipelineClass
+}
+
+func (i *JenkinsInstance) lastPipelineRun(job JenkinsJob) (*jenkinsPipelineRun, error) {
+	run := new(jenkinsPipelineRun)
+	if err := i.client.getJson(jenkinsUrl(job.Url, "lastBuild/wfapi/describe"), run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+func formatMillis(millis int64) string {
+	return (time.Duration(millis) * time.Millisecond).Round(time.Second).String()
+}
+
+func formatPipelineStage(stage jenkinsPipelineStage) string {
+	return fmt.Sprintf("  %-12s %-40s %s", stage.Status, stage.Name, formatMillis(stage.DurationMillis))
+}
+
+func formatPipelineRun(job JenkinsJob, run *jenkinsPipelineRun) string {
+	text := fmt.Sprintf("%s %s: %s (%s)\n", job.Name, run.Name, run.Status, formatMillis(run.DurationMillis))
+	for _, stage := range run.Stages {
+		text += formatPipelineStage(stage) + "\n"
+	}
+	return strings.TrimSuffix(text, "\n")
+}
+
+func isPipelineRunning(status string) bool {
+	switch status {
+	case "", "QUEUED", "NOT_EXECUTED", "IN_PROGRESS", "PAUSED_PENDING_INPUT":
+		return true
+	}
+	return false
+}
+
+// followPipelineRun waits for the build of the queue item to finish and
+// returns its stages. Finished stages are printed on the way.
+func (i *JenkinsInstance) followPipelineRun(job JenkinsJob, queueItemUrl string) (string, error) {
+	fmt.Printf("Waiting for %s to start\n", job.Name)
+	var item jenkinsQueueItem
+	for {
+		if err := i.client.getJson(jenkinsUrl(queueItemUrl, "api/json"), &item); err != nil {
+			return "", err
+		}
+		if item.Cancelled {
+			return "The build of " + job.Name + " was cancelled before it started", nil
+		}
+		if item.Executable != nil {
+			break
+		}
+		time.Sleep(jenkinsFollowInterval)
+	}
+	fmt.Printf("Following %s #%d\n", job.Name, item.Executable.Number)
+	printed := make(map[string]bool)
+	for {
+		run := new(jenkinsPipelineRun)
+		if err := i.client.getJson(jenkinsUrl(item.Executable.Url, "wfapi/describe"), run); err != nil {
+			return "", err
+		}
+		running := isPipelineRunning(run.Status)
+		for _, stage := range run.Stages {
+			if !printed[stage.Id] && !isPipelineRunning(stage.Status) && running {
+				printed[stage.Id] = true
+				fmt.Println(formatPipelineStage(stage))
+			}
+		}
+		if !running {
+			return formatPipelineRun(job, run), nil
+		}
+		time.Sleep(jenkinsFollowInterval)
+	}
+}
+
+// followOrStarted asks whether to follow a started pipeline build. Other jobs
+// have no stages to show.
+func (i *JenkinsInstance) followOrStarted(job JenkinsJob, queueItemUrl string, message string) string {
+	if !job.isPipeline() || queueItemUrl == "" || !confirm("Started "+job.Name+". Follow the build?") {
+		return message
+	}
+	stages, err := i.followPipelineRun(job, queueItemUrl)
+	if err != nil {
+		log.Fatalf("Could not follow the build of %s: %v", job.Name, err)
+	}
+	return message + "\n" + stages
+}
+
+type JenkinsStagesAction struct {
+	instance *JenkinsInstance
+	job      JenkinsJob
+}
+
+func (j JenkinsStagesAction) GetLabel() string {
+	return j.instance.label + " STAGES " + j.job.Name
+}
+
+func (j JenkinsStagesAction) Run() string {
+	run, err := j.instance.lastPipelineRun(j.job)
+	if err != nil {
+		log.Fatalf("Could not get stages of the last build of %s: %v", j.job.Name, err)
+	}
+	return formatPipelineRun(j.job, run)
+}
+
+type JenkinsFailedStageLogAction struct {
+	instance *JenkinsInstance
+	job      JenkinsJob
+}
+
+func (j JenkinsFailedStageLogAction) GetLabel() string {
+	return j.instance.label + " FAILED-STAGE " + j.job.Name
+}
+
+func (j JenkinsFailedStageLogAction) Run() string {
+	run, err := j.instance.lastPipelineRun(j.job)
+	if err != nil {
+		log.Fatalf("Could not get stages of the last build of %s: %v", j.job.Name, err)
+	}
+	var failedStage *jenkinsPipelineStage
+	for n := range run.Stages {
+		if run.Stages[n].Status == "FAILED" || run.Stages[n].Status == "UNSTABLE" {
+			failedStage = &run.Stages[n]
+			break
+		}
+	}
+	if failedStage == nil {
+		return "No failed stage in the last build\n" + formatPipelineRun(j.job, run)
+	}
+	// The stage node itself has no output, so we open the log of the step
+	// that failed if we can find it.
+	nodeId := failedStage.Id
+	stage := new(jenkinsPipelineStage)
+	stageUrl := jenkinsUrl(j.job.Url, run.Id+"/execution/node/"+failedStage.Id+"/wfapi/describe")
+	if err := j.instance.client.getJson(stageUrl, stage); err == nil {
+		for _, node := range stage.StageFlowNodes {
+			if node.Status == "FAILED" || node.Status == "UNSTABLE" {
+				nodeId = node.Id
+				break
+			}
+		}
+	}
+	url := jenkinsUrl(j.job.Url, run.Id+"/execution/node/"+nodeId+"/log/")
+	if err := launchUrl(url); err != nil {
+		log.Fatalf("Could not browse %s: %v", url, err)
+	}
+	return "Opened log of stage " + failedStage.Name + "\n" + formatPipelineRun(j.job, run)
+}
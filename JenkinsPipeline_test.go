@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestJenkinsInstanceFollowPipelineRun(t *testing.T) {
+	interval := jenkinsFollowInterval
+	jenkinsFollowInterval = 0
+	defer func() { jenkinsFollowInterval = interval }()
+
+	requests := map[string]int{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/job/app/build":
+			w.Header().Set("Location", server.URL+"/queue/item/7/")
+			w.WriteHeader(http.StatusCreated)
+		case "/queue/item/7/api/json":
+			if requests[r.URL.Path] == 1 {
+				_, _ = fmt.Fprint(w, `{"cancelled":false}`)
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"cancelled":false,"executable":{"number":42,"url":"%s/job/app/42/"}}`, server.URL)
+		case "/job/app/42/wfapi/describe":
+			if requests[r.URL.Path] == 1 {
+				_, _ = fmt.Fprint(w, `{"id":"42","name":"#42","status":"IN_PROGRESS","durationMillis":3000,"stages":[
+					{"id":"6","name":"Build","status":"SUCCESS","durationMillis":2000},
+					{"id":"12","name":"Test","status":"IN_PROGRESS","durationMillis":1000}]}`)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"id":"42","name":"#42","status":"FAILED","durationMillis":9000,"stages":[
+				{"id":"6","name":"Build","status":"SUCCESS","durationMillis":2000},
+				{"id":"12","name":"Test","status":"FAILED","durationMillis":7000}]}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	instance := &JenkinsInstance{name: "default", client: NewJenkinsClient(server.URL, "jdoe", "token")}
+	job := JenkinsJob{Class: jenkinsPipelineClass, Name: "app", Url: server.URL + "/job/app/"}
+	queueItemUrl, err := instance.client.postForLocation(jenkinsUrl(job.Url, "build"), url.Values{}, "Job/Build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queueItemUrl != server.URL+"/queue/item/7/" {
+		t.Fatalf("postForLocation() = %q", queueItemUrl)
+	}
+	stages, err := instance.followPipelineRun(job, queueItemUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"app #42: FAILED (9s)",
+		formatPipelineStage(jenkinsPipelineStage{Name: "Build", Status: "SUCCESS", DurationMillis: 2000}),
+		formatPipelineStage(jenkinsPipelineStage{Name: "Test", Status: "FAILED", DurationMillis: 7000}),
+	}, "\n")
+	if stages != want {
+		t.Errorf("followPipelineRun() = %q, want %q", stages, want)
+	}
+	if requests["/queue/item/7/api/json"] != 2 || requests["/job/app/42/wfapi/describe"] != 2 {
+		t.Errorf("unexpected number of polls: %v", requests)
+	}
+}
+
+func TestJenkinsInstanceFollowCancelledPipelineRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"cancelled":true}`)
+	}))
+	defer server.Close()
+
+	instance := &JenkinsInstance{name: "default", client: NewJenkinsClient(server.URL, "jdoe", "token")}
+	message, err := instance.followPipelineRun(JenkinsJob{Name: "app"}, server.URL+"/queue/item/8/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != "The build of app was cancelled before it started" {
+		t.Errorf("followPipelineRun() = %q", message)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// JiraModule indexes the issues of configurable JQL filters of a jira cloud or
+// data center installation.
+type JiraModule struct {
+	httpUrl      string
+	username     string
+	token        string
+	filters      []jiraFilterSettings
+	maxResults   int
+	branchPrefix string
+	api          *ApiClient
+	issues       []JiraIssue
+}
+
+type jiraFilterSettings struct {
+	Name string `mapstructure:"name"`
+	Jql  string `mapstructure:"jql"`
+}
+
+type JiraIssue struct {
+	Key    string `json:"key"`
+	Fields struct {
+		Summary string `json:"summary"`
+		Status  struct {
+			Name string `json:"name"`
+		} `json:"status"`
+		IssueType struct {
+			Name string `json:"name"`
+		} `json:"issuetype"`
+		Assignee *struct {
+			DisplayName string `json:"displayName"`
+		} `json:"assignee"`
+		Project struct {
+			Key  string `json:"key"`
+			Name string `json:"name"`
+		} `json:"project"`
+		Labels []string `json:"labels"`
+	} `json:"fields"`
+	// Filters that found the issue. Not part of the api response.
+	Filters []string `json:"filters"`
+}
+
+type jiraSearchResult struct {
+	StartAt       int         `json:"startAt"`
+	Total         int         `json:"total"`
+	NextPageToken string      `json:"nextPageToken"`
+	IsLast        bool        `json:"isLast"`
+	Issues        []JiraIssue `json:"issues"`
+}
+
+type jiraTransitions struct {
+	Transitions []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+		To   struct {
+			Name string `json:"name"`
+		} `json:"to"`
+	} `json:"transitions"`
+}
+
+const jiraIssueFields = "summary,status,issuetype,assignee,project,labels"
+
+var jiraIssueKeyPattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]+-[0-9]+$`)
+
+var defaultJiraFilters = []jiraFilterSettings{
+	{Name: "mine", Jql: "assignee = currentUser() AND resolution = Unresolved ORDER BY updated DESC"},
+}
+
+func NewJiraModule() *JiraModule {
+	return new(JiraModule)
+}
+
+func (j *JiraModule) Name() string {
+	return "Jira"
+}
+
+func (j *JiraModule) Description() string {
+	return "Provides access to jira issues"
+}
+
+func (j *JiraModule) CanBeDisabled() bool {
+	return true
+}
+
+func (j *JiraModule) UpdateSettings() {
+	configKey := j.Name() + ".http-url"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'https://example.atlassian.net')", configKey)
+	}
+	j.httpUrl = strings.TrimSuffix(viper.GetString(configKey), "/")
+
+	configKey = j.Name() + ".token"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'jira_api_token')", configKey)
+	}
+	j.token = viper.GetString(configKey)
+	// Jira cloud needs the email address with the api token, data center
+	// accepts a personal access token alone.
+	j.username = viper.GetString(j.Name() + ".username")
+
+	j.filters = defaultJiraFilters
+	if configKey = j.Name() + ".filters"; viper.IsSet(configKey) {
+		var filters []jiraFilterSettings
+		if err := viper.UnmarshalKey(configKey, &filters); err != nil {
+			log.Fatalf("Invalid configuration key `%s`: %v", configKey, err)
+		}
+		for _, filter := range filters {
+			if filter.Name == "" || filter.Jql == "" {
+				log.Fatalf("Every entry of `%s` needs a `name` and a `jql`", configKey)
+			}
+		}
+		j.filters = filters
+	}
+	j.maxResults = 200
+	if configKey = j.Name() + ".max-results"; viper.IsSet(configKey) {
+		j.maxResults = viper.GetInt(configKey)
+	}
+	j.branchPrefix = "feature/"
+	if configKey = j.Name() + ".branch-prefix"; viper.IsSet(configKey) {
+		j.branchPrefix = viper.GetString(configKey)
+	}
+	j.api = NewApiClient(j.Name(), BasicOrBearerAuth(j.username, j.token))
+}
+
+func (j *JiraModule) NeedsExternalData() bool {
+	return true
+}
+
+func (j *JiraModule) UpdateExternalData() {
+	var issues []JiraIssue
+	byKey := make(map[string]int)
+	for _, filter := range j.filters {
+		found, err := j.Search(filter.Jql)
+		if err != nil {
+			log.Fatalf("Cannot search jira issues for filter %s: %v", filter.Name, err)
+		}
+		fmt.Printf("  - %d issues in filter %s\n", len(found), filter.Name)
+		for _, issue := range found {
+			if i, known := byKey[issue.Key]; known {
+				issues[i].Filters = append(issues[i].Filters, filter.Name)
+				continue
+			}
+			issue.Filters = []string{filter.Name}
+			byKey[issue.Key] = len(issues)
+			issues = append(issues, issue)
+		}
+	}
+	j.issues = issues
+}
+
+// isCloud is true for jira cloud, which has a different search api
+func (j *JiraModule) isCloud() bool {
+	parsedUrl, err := url.Parse(j.httpUrl)
+	return err == nil && strings.HasSuffix(parsedUrl.Hostname(), ".atlassian.net")
+}
+
+// Search returns up to maxResults issues found by the jql
+func (j *JiraModule) Search(jql string) ([]JiraIssue, error) {
+	var issues []JiraIssue
+	query := url.Values{}
+	query.Set("jql", jql)
+	query.Set("fields", jiraIssueFields)
+	query.Set("maxResults", "100")
+	for len(issues) < j.maxResults {
+		var result jiraSearchResult
+		if j.isCloud() {
+			if _, err := j.api.GetJson(j.httpUrl+"/rest/api/2/search/jql?"+query.Encode(), &result); err != nil {
+				return nil, err
+			}
+			issues = append(issues, result.Issues...)
+			if result.IsLast || result.NextPageToken == "" {
+				break
+			}
+			query.Set("nextPageToken", result.NextPageToken)
+		} else {
+			query.Set("startAt", strconv.Itoa(len(issues)))
+			if _, err := j.api.GetJson(j.httpUrl+"/rest/api/2/search?"+query.Encode(), &result); err != nil {
+				return nil, err
+			}
+			issues = append(issues, result.Issues...)
+			if len(result.Issues) == 0 || len(issues) >= result.Total {
+				break
+			}
+		}
+	}
+	if len(issues) > j.maxResults {
+		issues = issues[:j.maxResults]
+	}
+	return issues, nil
+}
+
+func (j *JiraModule) WriteExternalData(file *os.File) {
+	bytes, err := json.Marshal(j.issues)
+	if err != nil {
+		log.Fatalf("Cannot serialize jira issues: %s", err)
+	}
+	if _, err = file.Write(bytes); err != nil {
+		log.Fatalf("Cannot write jira issues to %v: %s", file, err)
+	}
+}
+
+func (j *JiraModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &j.issues)
+}
+
+func (j *JiraModule) issueUrl(key string) string {
+	return j.httpUrl + "/browse/" + key
+}
+
+func (i JiraIssue) label(verb string) string {
+	return "[jira[] " + verb + " " + i.Key + " " + i.Fields.Summary + " (" + i.Fields.Status.Name + ")"
+}
+
+// branchName builds a branch name from the key and the summary of the issue,
+// eg. "feature/PAY-1234-refund-failed-payments"
+func (i JiraIssue) branchName(prefix string) string {
+	slug := strings.Trim(nonBranchCharacters.ReplaceAllString(strings.ToLower(i.Fields.Summary), "-"), "-")
+	if len(slug) > 40 {
+		slug = strings.TrimRight(slug[:40], "-")
+	}
+	if slug == "" {
+		return prefix + i.Key
+	}
+	return prefix + i.Key + "-" + slug
+}
+
+var nonBranchCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+type JiraBrowseAction struct {
+	label string
+	url   string
+}
+
+func (j JiraBrowseAction) GetLabel() string {
+	return j.label
+}
+
+func (j JiraBrowseAction) Run() string {
+	if err := launchUrl(j.url); err != nil {
+		log.Fatalf("Could not browse %s: %v", j.url, err)
+	}
+	return "Opened " + j.url
+}
+
+type JiraTransitionAction struct {
+	issue      JiraIssue
+	jiraModule *JiraModule
+}
+
+func (j JiraTransitionAction) GetLabel() string {
+	return j.issue.label("TRANSITION")
+}
+
+// Run lists the transitions that are currently possible and asks which one
+// to do.
+func (j JiraTransitionAction) Run() string {
+	transitionsUrl := j.jiraModule.httpUrl + "/rest/api/2/issue/" + url.PathEscape(j.issue.Key) + "/transitions"
+	var transitions jiraTransitions
+	if _, err := j.jiraModule.api.GetJson(transitionsUrl, &transitions); err != nil {
+		log.Fatalf("Could not get transitions of %s: %v", j.issue.Key, err)
+	}
+	if len(transitions.Transitions) == 0 {
+		return "No transitions possible for " + j.issue.Key
+	}
+	for n, transition := range transitions.Transitions {
+		fmt.Printf("%d) %s -> %s\n", n+1, transition.Name, transition.To.Name)
+	}
+	choice, err := strconv.Atoi(prompt("Transition:", ""))
+	if err != nil || choice < 1 || choice > len(transitions.Transitions) {
+		return "Cancelled"
+	}
+	transition := transitions.Transitions[choice-1]
+	body := map[string]interface{}{"transition": map[string]string{"id": transition.Id}}
+	if err := j.jiraModule.api.SendJson("POST", transitionsUrl, body, nil); err != nil {
+		log.Fatalf("Could not transition %s: %v", j.issue.Key, err)
+	}
+	return j.issue.Key + " is now " + transition.To.Name
+}
+
+type JiraCreateBranchAction struct {
+	issue      JiraIssue
+	jiraModule *JiraModule
+}
+
+func (j JiraCreateBranchAction) GetLabel() string {
+	return j.issue.label("BRANCH")
+}
+
+// Run creates the branch in the git repository of the current directory
+func (j JiraCreateBranchAction) Run() string {
+	branch := prompt("Branch:", j.issue.branchName(j.jiraModule.branchPrefix))
+	if err := runGit("", "checkout", "-b", branch); err != nil {
+		log.Fatalf("Could not create branch %s: %v", branch, err)
+	}
+	return "Created branch " + branch
+}
+
+func (j *JiraModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	known := make(map[string]bool)
+	projects := make(map[string]bool)
+	for _, issue := range j.issues {
+		known[issue.Key] = true
+		projects[issue.Fields.Project.Key] = true
+		strs := []string{
+			"jira", "issue", issue.Key, issue.Fields.Summary, issue.Fields.Status.Name,
+			issue.Fields.IssueType.Name, issue.Fields.Project.Key, issue.Fields.Project.Name,
+		}
+		if issue.Fields.Assignee != nil {
+			strs = append(strs, issue.Fields.Assignee.DisplayName)
+		}
+		strs = append(strs, issue.Fields.Labels...)
+		strs = append(strs, issue.Filters...)
+		if DoMatch(append(strs, "browse"), tags) {
+			actions = append(actions, JiraBrowseAction{label: issue.label("BROWSE"), url: j.issueUrl(issue.Key)})
+		}
+		if DoMatch(append(strs, "transition"), tags) {
+			actions = append(actions, JiraTransitionAction{issue: issue, jiraModule: j})
+		}
+		if DoMatch(append(strs, "branch"), tags) {
+			actions = append(actions, JiraCreateBranchAction{issue: issue, jiraModule: j})
+		}
+	}
+	// Issue keys that are not in any filter can still be browsed directly.
+	// Lower case keys are only taken for known projects, as words like
+	// utf-8 look like keys, too.
+	for _, tag := range tags {
+		key := tag.value
+		if !jiraIssueKeyPattern.MatchString(key) {
+			key = strings.ToUpper(key)
+			if !jiraIssueKeyPattern.MatchString(key) || !projects[key[:strings.LastIndex(key, "-")]] {
+				continue
+			}
+		}
+		if !known[key] {
+			known[key] = true
+			actions = append(actions, JiraBrowseAction{label: "[jira[] BROWSE " + key, url: j.issueUrl(key)})
+		}
+	}
+	return actions
+}
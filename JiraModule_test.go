@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJiraCreateActionsBrowsesIssueKeys(t *testing.T) {
+	issue := JiraIssue{Key: "PAY-1"}
+	issue.Fields.Summary = "Reject expired cards"
+	issue.Fields.Project.Key = "PAY"
+	j := &JiraModule{httpUrl: "https://jira.example.com", issues: []JiraIssue{issue}}
+
+	tests := []struct {
+		tag  string
+		want []string
+	}{
+		{"PAY-1234", []string{"https://jira.example.com/browse/PAY-1234"}},
+		{"pay-1234", []string{"https://jira.example.com/browse/PAY-1234"}},
+		{"OPS-7", []string{"https://jira.example.com/browse/OPS-7"}},
+		{"ops-7", nil},
+		{"utf-8", nil},
+		{"java-17", nil},
+		{"log4j-2", nil},
+		{"PAY-1", []string{"https://jira.example.com/browse/PAY-1"}},
+		{"pay-", []string{"https://jira.example.com/browse/PAY-1"}},
+	}
+	for _, test := range tests {
+		var urls []string
+		for _, action := range j.CreateActions([]Tag{{value: test.tag, matchMode: Contains}}) {
+			if browse, ok := action.(JiraBrowseAction); ok {
+				urls = append(urls, browse.url)
+			}
+		}
+		if !reflect.DeepEqual(urls, test.want) {
+			t.Errorf("CreateActions(%q) browses %q, want %q", test.tag, urls, test.want)
+		}
+	}
+}
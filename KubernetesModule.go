@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// KubernetesModule provides the contexts of the kubeconfig and, for selected
+// contexts, their namespaces and deployments. It uses kubectl, so the
+// kubeconfig and credentials work as they do on the command line.
+type KubernetesModule struct {
+	kubectl      string
+	contexts     []string
+	dashboardUrl string
+	data         KubernetesData
+}
+
+type KubernetesData struct {
+	Contexts    []KubernetesContext    `json:"contexts"`
+	Deployments []KubernetesDeployment `json:"deployments"`
+}
+
+type KubernetesContext struct {
+	Name      string `json:"name"`
+	Cluster   string `json:"cluster"`
+	User      string `json:"user"`
+	Namespace string `json:"namespace"`
+	// Namespaces are only listed for the configured contexts
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+type KubernetesDeployment struct {
+	Context   string `json:"context"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Replicas  int    `json:"replicas"`
+	Ready     int    `json:"ready"`
+	Ports     []int  `json:"ports"`
+}
+
+type kubeConfig struct {
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+}
+
+type kubernetesList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Spec struct {
+			Replicas *int `json:"replicas"`
+			Template struct {
+				Spec struct {
+					Containers []struct {
+						Ports []struct {
+							ContainerPort int `json:"containerPort"`
+						} `json:"ports"`
+					} `json:"containers"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+		Status struct {
+			ReadyReplicas int `json:"readyReplicas"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func NewKubernetesModule() *KubernetesModule {
+	return new(KubernetesModule)
+}
+
+func (k *KubernetesModule) Name() string {
+	return "Kubernetes"
+}
+
+func (k *KubernetesModule) Description() string {
+	return "Provides access to kubernetes contexts and deployments"
+}
+
+func (k *KubernetesModule) CanBeDisabled() bool {
+	return true
+}
+
+func (k *KubernetesModule) UpdateSettings() {
+	k.kubectl = "kubectl"
+	if configKey := k.Name() + ".kubectl"; viper.IsSet(configKey) {
+		k.kubectl = viper.GetString(configKey)
+	}
+	k.contexts = viper.GetStringSlice(k.Name() + ".contexts")
+	k.dashboardUrl = viper.GetString(k.Name() + ".dashboard-url")
+}
+
+func (k *KubernetesModule) NeedsExternalData() bool {
+	return true
+}
+
+func (k *KubernetesModule) UpdateExternalData() {
+	var config kubeConfig
+	if err := k.getJson(&config, "config", "view"); err != nil {
+		log.Fatalf("Cannot read kubeconfig: %v", err)
+	}
+	data := KubernetesData{}
+	for _, context := range config.Contexts {
+		data.Contexts = append(data.Contexts, KubernetesContext{
+			Name:      context.Name,
+			Cluster:   context.Context.Cluster,
+			User:      context.Context.User,
+			Namespace: context.Context.Namespace,
+		})
+	}
+	fmt.Printf("  - %d contexts\n", len(data.Contexts))
+	for i, context := range data.Contexts {
+		if !k.isCached(context.Name) {
+			continue
+		}
+		namespaces, err := k.ListNamespaces(context.Name)
+		if err != nil {
+			fmt.Printf("  ! Cannot list namespaces of %s: %v\n", context.Name, err)
+			continue
+		}
+		data.Contexts[i].Namespaces = namespaces
+		deployments, err := k.ListDeployments(context.Name)
+		if err != nil {
+			fmt.Printf("  ! Cannot list deployments of %s: %v\n", context.Name, err)
+			continue
+		}
+		fmt.Printf("  - %d namespaces and %d deployments in %s\n", len(namespaces), len(deployments), context.Name)
+		data.Deployments = append(data.Deployments, deployments...)
+	}
+	k.data = data
+}
+
+func (k *KubernetesModule) isCached(context string) bool {
+	for _, cached := range k.contexts {
+		if cached == context {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *KubernetesModule) ListNamespaces(context string) ([]string, error) {
+	var list kubernetesList
+	if err := k.getJson(&list, "--context", context, "get", "namespaces"); err != nil {
+		return nil, err
+	}
+	var namespaces []string
+	for _, item := range list.Items {
+		namespaces = append(namespaces, item.Metadata.Name)
+	}
+	return namespaces, nil
+}
+
+// ListDeployments lists the deployments of all namespaces
+func (k *KubernetesModule) ListDeployments(context string) ([]KubernetesDeployment, error) {
+	var list kubernetesList
+	if err := k.getJson(&list, "--context", context, "get", "deployments", "--all-namespaces"); err != nil {
+		return nil, err
+	}
+	var deployments []KubernetesDeployment
+	for _, item := range list.Items {
+		deployment := KubernetesDeployment{
+			Context:   context,
+			Namespace: item.Metadata.Namespace,
+			Name:      item.Metadata.Name,
+			Replicas:  1,
+			Ready:     item.Status.ReadyReplicas,
+		}
+		if item.Spec.Replicas != nil {
+			deployment.Replicas = *item.Spec.Replicas
+		}
+		for _, container := range item.Spec.Template.Spec.Containers {
+			for _, port := range container.Ports {
+				deployment.Ports = append(deployment.Ports, port.ContainerPort)
+			}
+		}
+		deployments = append(deployments, deployment)
+	}
+	return deployments, nil
+}
+
+// getJson runs kubectl with json output
+func (k *KubernetesModule) getJson(target interface{}, args ...string) error {
+	proc := exec.Command(k.kubectl, append(args, "--output", "json")...)
+	proc.Stderr = os.Stderr
+	output, err := proc.Output()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(output, target)
+}
+
+func (k *KubernetesModule) WriteExternalData(file *os.File) {
+	bytes, err := json.Marshal(k.data)
+	if err != nil {
+		log.Fatalf("Cannot serialize kubernetes data: %s", err)
+	}
+	if _, err = file.Write(bytes); err != nil {
+		log.Fatalf("Cannot write kubernetes data to %v: %s", file, err)
+	}
+}
+
+func (k *KubernetesModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &k.data)
+}
+
+// workloadUrl fills the dashboard url template
+func (k *KubernetesModule) workloadUrl(deployment KubernetesDeployment) string {
+	return strings.NewReplacer(
+		"{context}", deployment.Context,
+		"{namespace}", deployment.Namespace,
+		"{name}", deployment.Name,
+	).Replace(k.dashboardUrl)
+}
+
+type KubernetesUseContextAction struct {
+	kubectl string
+	context KubernetesContext
+	// namespace is empty to keep the namespace of the context
+	namespace string
+}
+
+func (k KubernetesUseContextAction) GetLabel() string {
+	label := "[k8s[] USE " + k.context.Name
+	if k.namespace != "" {
+		label += " namespace " + k.namespace
+	}
+	return label
+}
+
+func (k KubernetesUseContextAction) Run() string {
+	if err := runCommand("", k.kubectl, "config", "use-context", k.context.Name); err != nil {
+		log.Fatalf("Could not switch to context %s: %v", k.context.Name, err)
+	}
+	if k.namespace == "" {
+		return "Switched to context " + k.context.Name
+	}
+	if err := runCommand("", k.kubectl, "config", "set-context", "--current", "--namespace", k.namespace); err != nil {
+		log.Fatalf("Could not switch to namespace %s: %v", k.namespace, err)
+	}
+	return "Switched to context " + k.context.Name + " and namespace " + k.namespace
+}
+
+// KubernetesCommandAction prints a kubectl command for a deployment and offers
+// to run it.
+type KubernetesCommandAction struct {
+	verb       string
+	kubectl    string
+	deployment KubernetesDeployment
+}
+
+func (k KubernetesCommandAction) GetLabel() string {
+	d := k.deployment
+	return "[k8s[] " + k.verb + " " + d.Context + "/" + d.Namespace + "/" + d.Name +
+		" (" + strconv.Itoa(d.Ready) + "/" + strconv.Itoa(d.Replicas) + ")"
+}
+
+func (k KubernetesCommandAction) Run() string {
+	d := k.deployment
+	args := []string{"--context", d.Context, "--namespace", d.Namespace}
+	if k.verb == "LOGS" {
+		args = append(args, "logs", "-f", "deployment/"+d.Name)
+	} else {
+		remotePort := prompt("Remote port:", k.defaultPort())
+		localPort := prompt("Local port:", remotePort)
+		if !isPort(remotePort) || !isPort(localPort) {
+			return "Cannot forward port `" + localPort + "` to `" + remotePort + "`"
+		}
+		args = append(args, "port-forward", "deployment/"+d.Name, localPort+":"+remotePort)
+	}
+	command := strings.Join(append([]string{k.kubectl}, args...), " ")
+	fmt.Println(command)
+	if !confirm("Run it?") {
+		return command
+	}
+	if err := runCommand("", k.kubectl, args...); err != nil {
+		return "Command failed: " + err.Error()
+	}
+	return "Done"
+}
+
+func isPort(port string) bool {
+	number, err := strconv.Atoi(port)
+	return err == nil && number > 0 && number <= 65535
+}
+
+func (k KubernetesCommandAction) defaultPort() string {
+	if len(k.deployment.Ports) == 0 {
+		return ""
+	}
+	return strconv.Itoa(k.deployment.Ports[0])
+}
+
+type KubernetesDashboardAction struct {
+	deployment KubernetesDeployment
+	url        string
+}
+
+func (k KubernetesDashboardAction) GetLabel() string {
+	d := k.deployment
+	return "[k8s[] DASHBOARD " + d.Context + "/" + d.Namespace + "/" + d.Name
+}
+
+func (k KubernetesDashboardAction) Run() string {
+	if err := launchUrl(k.url); err != nil {
+		log.Fatalf("Could not browse %s: %v", k.url, err)
+	}
+	return "Opened " + k.url
+}
+
+func (k *KubernetesModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	for _, context := range k.data.Contexts {
+		strs := []string{"k8s", "kubernetes", "kubectl", "context", "use", context.Name, context.Cluster, context.User, context.Namespace}
+		if DoMatch(strs, tags) {
+			actions = append(actions, KubernetesUseContextAction{kubectl: k.kubectl, context: context})
+		}
+		for _, namespace := range context.Namespaces {
+			if DoMatch(append(strs, "namespace", namespace), tags) {
+				actions = append(actions, KubernetesUseContextAction{kubectl: k.kubectl, context: context, namespace: namespace})
+			}
+		}
+	}
+	for _, deployment := range k.data.Deployments {
+		strs := []string{"k8s", "kubernetes", "deployment", deployment.Context, deployment.Namespace, deployment.Name}
+		if DoMatch(append(strs, "logs"), tags) {
+			actions = append(actions, KubernetesCommandAction{verb: "LOGS", kubectl: k.kubectl, deployment: deployment})
+		}
+		if DoMatch(append(strs, "port-forward"), tags) {
+			actions = append(actions, KubernetesCommandAction{verb: "PORT-FORWARD", kubectl: k.kubectl, deployment: deployment})
+		}
+		if k.dashboardUrl != "" && DoMatch(append(strs, "dashboard", "browse"), tags) {
+			actions = append(actions, KubernetesDashboardAction{deployment: deployment, url: k.workloadUrl(deployment)})
+		}
+	}
+	return actions
+}
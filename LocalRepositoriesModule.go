@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// LocalRepositoriesModule indexes the git working copies below the configured
+// directories.
+type LocalRepositoriesModule struct {
+	roots       []string
+	maxDepth    int
+	ignore      map[string]bool
+	editor      string
+	terminal    string
+	indexes     []RepositoryIndex
+	repos       []LocalRepository
+	hostedByUrl map[string]localHostedRepository
+}
+
+type LocalRepository struct {
+	Path    string        `json:"path"`
+	Branch  string        `json:"branch"`
+	Remotes []LocalRemote `json:"remotes"`
+}
+
+type LocalRemote struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+// localHostedRepository is a hosted repository and the module that knows it
+type localHostedRepository struct {
+	repo HostedRepository
+	host string
+}
+
+const defaultLocalRepositoriesMaxDepth = 4
+
+var defaultLocalRepositoriesIgnore = []string{"node_modules", "vendor", "target", "build", "dist", "venv", "__pycache__"}
+
+func NewLocalRepositoriesModule(indexes []RepositoryIndex) *LocalRepositoriesModule {
+	l := new(LocalRepositoriesModule)
+	l.indexes = indexes
+	return l
+}
+
+func (l *LocalRepositoriesModule) Name() string {
+	return "LocalRepositories"
+}
+
+func (l *LocalRepositoriesModule) Description() string {
+	return "Provides access to local git working copies"
+}
+
+func (l *LocalRepositoriesModule) CanBeDisabled() bool {
+	return true
+}
+
+func (l *LocalRepositoriesModule) UpdateSettings() {
+	configKey := l.Name() + ".roots"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. ['~/src'])", configKey)
+	}
+	l.roots = nil
+	for _, root := range viper.GetStringSlice(configKey) {
+		expanded, err := homedir.Expand(root)
+		if err != nil {
+			log.Fatalf("Invalid path %s in `%s`: %v", root, configKey, err)
+		}
+		l.roots = append(l.roots, expanded)
+	}
+
+	l.maxDepth = defaultLocalRepositoriesMaxDepth
+	if configKey = l.Name() + ".max-depth"; viper.IsSet(configKey) {
+		l.maxDepth = viper.GetInt(configKey)
+	}
+	ignore := defaultLocalRepositoriesIgnore
+	if configKey = l.Name() + ".ignore"; viper.IsSet(configKey) {
+		ignore = viper.GetStringSlice(configKey)
+	}
+	l.ignore = make(map[string]bool)
+	for _, name := range ignore {
+		l.ignore[name] = true
+	}
+
+	l.editor = viper.GetString(l.Name() + ".editor")
+	if l.editor == "" {
+		l.editor = os.Getenv("VISUAL")
+	}
+	if l.editor == "" {
+		l.editor = os.Getenv("EDITOR")
+	}
+	if l.editor == "" {
+		l.editor = "code"
+	}
+	l.terminal = viper.GetString(l.Name() + ".terminal")
+	if l.terminal == "" {
+		switch runtime.GOOS {
+		case "windows":
+			l.terminal = "start cmd"
+		case "darwin":
+			l.terminal = "open -a Terminal ."
+		default: // "linux", "freebsd", "openbsd", "netbsd"
+			l.terminal = "x-terminal-emulator"
+		}
+	}
+}
+
+func (l *LocalRepositoriesModule) NeedsExternalData() bool {
+	return true
+}
+
+func (l *LocalRepositoriesModule) UpdateExternalData() {
+	var repos []LocalRepository
+	for _, root := range l.roots {
+		l.scan(root, 0, &repos)
+	}
+	l.repos = repos
+	fmt.Printf("  - Found %d working copies\n", len(repos))
+}
+
+// scan adds dir to repos if it is a working copy, otherwise it descends into
+// the sub directories. Hidden and ignored directories are skipped.
+func (l *LocalRepositoriesModule) scan(dir string, depth int, repos *[]LocalRepository) {
+	if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+		repo, err := readLocalRepository(dir)
+		if err != nil {
+			fmt.Printf("  ! Cannot read working copy %s: %v\n", dir, err)
+			return
+		}
+		*repos = append(*repos, repo)
+		return
+	}
+	if depth >= l.maxDepth {
+		return
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if depth == 0 {
+			fmt.Printf("  ! Cannot read %s: %v\n", dir, err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(name, ".") || l.ignore[name] {
+			continue
+		}
+		l.scan(filepath.Join(dir, name), depth+1, repos)
+	}
+}
+
+// readLocalRepository reads the branch and the remotes from the git files, so
+// we do not need to run git for every working copy.
+func readLocalRepository(dir string) (LocalRepository, error) {
+	repo := LocalRepository{Path: dir}
+	gitDir := filepath.Join(dir, ".git")
+	if info, err := os.Stat(gitDir); err == nil && !info.IsDir() {
+		// Worktree or submodule: .git is a file pointing to the git dir
+		content, err := ioutil.ReadFile(gitDir)
+		if err != nil {
+			return repo, err
+		}
+		gitDir = strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir:"))
+		if !filepath.IsAbs(gitDir) {
+			gitDir = filepath.Join(dir, gitDir)
+		}
+	}
+	head, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return repo, err
+	}
+	if ref := strings.TrimSpace(string(head)); strings.HasPrefix(ref, "ref: refs/heads/") {
+		repo.Branch = strings.TrimPrefix(ref, "ref: refs/heads/")
+	} else if len(ref) >= 7 {
+		repo.Branch = "detached at " + ref[:7]
+	}
+	commonDir := gitDir
+	if content, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir = strings.TrimSpace(string(content))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+	}
+	config, err := os.Open(filepath.Join(commonDir, "config"))
+	if err != nil {
+		return repo, err
+	}
+	defer func() {
+		if err := config.Close(); err != nil {
+			log.Fatalf("Cannot close file %s: %s", config.Name(), err)
+		}
+	}()
+	remote := ""
+	scanner := bufio.NewScanner(config)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			remote = ""
+			if strings.HasPrefix(line, "[remote \"") {
+				remote = strings.TrimSuffix(strings.TrimPrefix(line, "[remote \""), "\"]")
+			}
+			continue
+		}
+		if key, value, found := cutConfigLine(line); remote != "" && found && key == "url" {
+			repo.Remotes = append(repo.Remotes, LocalRemote{Name: remote, Url: value})
+		}
+	}
+	return repo, scanner.Err()
+}
+
+func cutConfigLine(line string) (string, string, bool) {
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.ToLower(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:]), true
+}
+
+// normalizeRemoteUrl makes the different notations of the same remote
+// comparable, eg. `git@host:a/b.git`, `ssh://git@host/a/b` and
+// `https://user@host/a/b.git` all become `host/a/b`.
+func normalizeRemoteUrl(remote string) string {
+	remote = strings.ToLower(strings.TrimSpace(remote))
+	remote = strings.TrimSuffix(strings.TrimSuffix(remote, "/"), ".git")
+	if i := strings.Index(remote, "://"); i >= 0 {
+		remote = remote[i+3:]
+	} else if colon := strings.Index(remote, ":"); colon >= 0 {
+		// scp like syntax
+		remote = remote[:colon] + "/" + remote[colon+1:]
+	}
+	slash := strings.Index(remote, "/")
+	if slash < 0 {
+		return remote
+	}
+	host, path := remote[:slash], remote[slash:]
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		host = host[at+1:]
+	}
+	if colon := strings.Index(host, ":"); colon >= 0 {
+		host = host[:colon]
+	}
+	// Bitbucket server serves https clones below /scm/
+	if i := strings.Index(path, "/scm/"); i >= 0 {
+		path = path[i+4:]
+	}
+	return host + path
+}
+
+// hosted finds the hosted repository of a working copy by its remotes
+func (l *LocalRepositoriesModule) hosted(repo LocalRepository) (localHostedRepository, bool) {
+	if l.hostedByUrl == nil {
+		l.hostedByUrl = make(map[string]localHostedRepository)
+		for _, index := range l.indexes {
+			host := index.Keywords()[0]
+			for _, hostedRepo := range index.HostedRepositories() {
+				for _, link := range hostedRepo.CloneLinks {
+					l.hostedByUrl[normalizeRemoteUrl(link.Href)] = localHostedRepository{repo: hostedRepo, host: host}
+				}
+			}
+		}
+	}
+	for _, remote := range repo.Remotes {
+		if hosted, found := l.hostedByUrl[normalizeRemoteUrl(remote.Url)]; found {
+			return hosted, true
+		}
+	}
+	return localHostedRepository{}, false
+}
+
+func (l *LocalRepositoriesModule) WriteExternalData(file *os.File) {
+	bytes, err := json.Marshal(l.repos)
+	if err != nil {
+		log.Fatalf("Cannot serialize working copies: %s", err)
+	}
+	if _, err = file.Write(bytes); err != nil {
+		log.Fatalf("Cannot write working copies to %v: %s", file, err)
+	}
+}
+
+func (l *LocalRepositoriesModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &l.repos)
+}
+
+// localRepositoryLabel shows the path relative to the home directory, the
+// branch at the last update and the hosted repository, if known.
+func localRepositoryLabel(verb string, repo LocalRepository, hosted localHostedRepository, found bool) string {
+	path := repo.Path
+	if home, err := homedir.Dir(); err == nil && strings.HasPrefix(path, home+string(filepath.Separator)) {
+		path = "~" + strings.TrimPrefix(path, home)
+	}
+	label := "[local[] " + verb + " " + path
+	if repo.Branch != "" {
+		label += " (" + repo.Branch + ")"
+	}
+	if found {
+		label += " " + hosted.host + ":" + hosted.repo.FullName
+	}
+	return label
+}
+
+type LocalRepositoryAction struct {
+	verb   string
+	repo   LocalRepository
+	hosted localHostedRepository
+	found  bool
+	// bare results are printed without decoration, so they can be used in
+	// the shell
+	bare bool
+	run  func(repo LocalRepository) (string, error)
+}
+
+func (l LocalRepositoryAction) GetLabel() string {
+	return localRepositoryLabel(l.verb, l.repo, l.hosted, l.found)
+}
+
+func (l LocalRepositoryAction) BareOutput() bool {
+	return l.bare
+}
+
+func (l LocalRepositoryAction) Run() string {
+	message, err := l.run(l.repo)
+	if err != nil {
+		log.Fatalf("Could not %s %s: %v", strings.ToLower(l.verb), l.repo.Path, err)
+	}
+	return message
+}
+
+func (l *LocalRepositoriesModule) CreateActions(tags []Tag) []action {
+	verbs := []struct {
+		verb string
+		bare bool
+		run  func(repo LocalRepository) (string, error)
+	}{
+		{"OPEN", false, func(repo LocalRepository) (string, error) {
+			return "Opened " + repo.Path, runShell(repo.Path, l.editor+" .")
+		}},
+		{"TERMINAL", false, func(repo LocalRepository) (string, error) {
+			return "Opened terminal in " + repo.Path, runShell(repo.Path, l.terminal)
+		}},
+		// Prints the bare path for `cd "$(fu -l cd my-repo)"`
+		{"CD", true, func(repo LocalRepository) (string, error) {
+			return repo.Path, nil
+		}},
+		{"PULL", false, func(repo LocalRepository) (string, error) {
+			return "Pulled " + repo.Path, runGit(repo.Path, "pull", "--ff-only")
+		}},
+		{"STATUS", false, func(repo LocalRepository) (string, error) {
+			status, err := gitOutput(repo.Path, "status", "--short", "--branch")
+			return strings.TrimSuffix(status, "\n"), err
+		}},
+	}
+	var actions []action
+	for _, repo := range l.repos {
+		strs := []string{"local", filepath.Base(repo.Path), repo.Path, repo.Branch}
+		for _, remote := range repo.Remotes {
+			strs = append(strs, remote.Url)
+		}
+		hosted, found := l.hosted(repo)
+		if found {
+			strs = append(strs, hosted.host, hosted.repo.Name, hosted.repo.Project)
+			strs = append(strs, hosted.repo.Topics...)
+		}
+		for _, verb := range verbs {
+			if DoMatch(append(strs, strings.ToLower(verb.verb)), tags) {
+				actions = append(actions, LocalRepositoryAction{verb: verb.verb, repo: repo, hosted: hosted, found: found, bare: verb.bare, run: verb.run})
+			}
+		}
+	}
+	return actions
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultReadmeMaxSize is the number of bytes of a README we store, if the
+// module does not configure `readme-max-size`
+const defaultReadmeMaxSize = 32 * 1024
+
+// readReadmeMaxSize reads the `readme-max-size` setting of a module
+func readReadmeMaxSize(moduleName string) int {
+	configKey := moduleName + ".readme-max-size"
+	if !viper.IsSet(configKey) {
+		return defaultReadmeMaxSize
+	}
+	return viper.GetInt(configKey)
+}
+
+// readmeDownloadLimit is the number of bytes we download for a README of at
+// most maxSize bytes. The markup takes up some space, that we strip later. A
+// maxSize <= 0 means no limit, like with cleanReadme.
+func readmeDownloadLimit(maxSize int) int64 {
+	if maxSize <= 0 {
+		return -1
+	}
+	return int64(4 * maxSize)
+}
+
+// readmeNames in order of preference
+var readmeNames = []string{
+	"readme.md",
+	"readme.markdown",
+	"readme.rst",
+	"readme.adoc",
+	"readme.asciidoc",
+	"readme.txt",
+	"readme.org",
+	"readme",
+}
+
+// readmeRank returns the preference of a file name as README or -1 if it is
+// no README at all. Lower is better.
+func readmeRank(fileName string) int {
+	fileName = strings.ToLower(fileName)
+	for rank, readmeName := range readmeNames {
+		if fileName == readmeName {
+			return rank
+		}
+	}
+	return -1
+}
+
+// selectReadme returns the preferred README from a list of file names in the
+// root of a repository or "" if there is none.
+func selectReadme(fileNames []string) string {
+	selected := ""
+	selectedRank := -1
+	for _, fileName := range fileNames {
+		rank := readmeRank(fileName)
+		if rank >= 0 && (selectedRank < 0 || rank < selectedRank) {
+			selected = fileName
+			selectedRank = rank
+		}
+	}
+	return selected
+}
+
+var (
+	htmlCommentPattern   = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlTagPattern       = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	markdownImagePattern = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLinkPattern  = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markdownRefPattern   = regexp.MustCompile(`(?m)^\s*\[[^\]]+\]:\s*\S+.*$`)
+	rstLinkPattern       = regexp.MustCompile("`([^`<]*?)\\s*<[^>]+>`_+")
+	adocLinkPattern      = regexp.MustCompile(`(?:link:|https?://)[^\s\[]*\[([^\]]*)\]`)
+	urlPattern           = regexp.MustCompile(`(?:https?|ftp|mailto):[^\s)\]>]+`)
+	whitespacePattern    = regexp.MustCompile(`[ \t]+`)
+	blankLinesPattern    = regexp.MustCompile(`\n{3,}`)
+)
+
+// cleanReadme strips html and link markup, so the search only matches the
+// text of a README, and cuts it to maxSize bytes.
+func cleanReadme(text string, maxSize int) string {
+	text = rstLinkPattern.ReplaceAllString(text, "$1")
+	text = htmlCommentPattern.ReplaceAllString(text, "")
+	text = htmlTagPattern.ReplaceAllString(text, "")
+	text = markdownImagePattern.ReplaceAllString(text, "$1")
+	text = markdownLinkPattern.ReplaceAllString(text, "$1")
+	text = markdownRefPattern.ReplaceAllString(text, "")
+	text = adocLinkPattern.ReplaceAllString(text, "$1")
+	text = urlPattern.ReplaceAllString(text, "")
+	text = whitespacePattern.ReplaceAllString(text, " ")
+	text = blankLinesPattern.ReplaceAllString(text, "\n\n")
+	text = strings.TrimSpace(text)
+	if maxSize > 0 && len(text) > maxSize {
+		// Do not cut a multi byte character in half
+		cut := maxSize
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+	}
+	return text
+}
@@ -0,0 +1,132 @@
+package main
+
+import "testing"
+
+func TestSelectReadme(t *testing.T) {
+	tests := []struct {
+		name      string
+		fileNames []string
+		want      string
+	}{
+		{"no files", nil, ""},
+		{"no readme", []string{"main.go", "go.mod", "READ.me"}, ""},
+		{"single readme", []string{"LICENSE", "README.md"}, "README.md"},
+		{"keeps the case", []string{"Readme.MD"}, "Readme.MD"},
+		{"markdown before plain text", []string{"README.txt", "README", "README.md"}, "README.md"},
+		{"rst before adoc", []string{"README.adoc", "README.rst"}, "README.rst"},
+		{"extension before none", []string{"README", "readme.org"}, "readme.org"},
+		{"readme in another format", []string{"README.pdf", "README"}, "README"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := selectReadme(test.fileNames); got != test.want {
+				t.Errorf("selectReadme(%q) = %q, want %q", test.fileNames, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCleanReadme(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		maxSize int
+		want    string
+	}{
+		{
+			name: "plain text",
+			text: "  Payment service\n",
+			want: "Payment service",
+		},
+		{
+			name: "html",
+			text: "<!-- badges -->\n<p align=\"center\"><img src=\"logo.png\"></p>\n<b>Payment</b> service",
+			want: "Payment service",
+		},
+		{
+			name: "markdown links and images",
+			text: "![Build status](https://ci/badge.svg) See the [docs](https://docs/payment).\n\n[api]: https://api/payment",
+			want: "Build status See the docs.",
+		},
+		{
+			name: "rst link",
+			text: "See the `manual <https://docs/payment>`_ for details",
+			want: "See the manual for details",
+		},
+		{
+			name: "asciidoc links",
+			text: "See https://docs/payment[the docs] or link:CONTRIBUTING.adoc[contributing]",
+			want: "See the docs or contributing",
+		},
+		{
+			name: "bare urls",
+			text: "Deployed to https://payment.example.com (ask mailto:team@example.com)",
+			want: "Deployed to (ask )",
+		},
+		{
+			name: "whitespace",
+			text: "Payment\t\t  service\n\n\n\n\nTeam Ops",
+			want: "Payment service\n\nTeam Ops",
+		},
+		{
+			name:    "cut",
+			text:    "Payment service",
+			maxSize: 7,
+			want:    "Payment",
+		},
+		{
+			name:    "short enough",
+			text:    "Payment",
+			maxSize: 7,
+			want:    "Payment",
+		},
+		{
+			name:    "cut before a multi byte character",
+			text:    "Zahlungsdienst für Überweisungen",
+			maxSize: 16,
+			want:    "Zahlungsdienst f",
+		},
+		{
+			name:    "cut inside a multi byte character",
+			text:    "Zahlungsdienst für Überweisungen",
+			maxSize: 17,
+			want:    "Zahlungsdienst f",
+		},
+		{
+			name:    "cut after a multi byte character",
+			text:    "Zahlungsdienst für Überweisungen",
+			maxSize: 18,
+			want:    "Zahlungsdienst fü",
+		},
+		{
+			name:    "no limit",
+			text:    "Zahlungsdienst für Überweisungen",
+			maxSize: 0,
+			want:    "Zahlungsdienst für Überweisungen",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cleanReadme(test.text, test.maxSize); got != test.want {
+				t.Errorf("cleanReadme(%q, %d) = %q, want %q", test.text, test.maxSize, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadmeDownloadLimit(t *testing.T) {
+	tests := []struct {
+		maxSize int
+		want    int64
+	}{
+		{defaultReadmeMaxSize, 4 * defaultReadmeMaxSize},
+		{100, 400},
+		{0, -1},
+		{-1, -1},
+	}
+	for _, test := range tests {
+		if got := readmeDownloadLimit(test.maxSize); got != test.want {
+			t.Errorf("readmeDownloadLimit(%d) = %d, want %d", test.maxSize, got, test.want)
+		}
+	}
+}
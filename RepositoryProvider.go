@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// RepositoryProvider is implemented by every git host whose repositories we
+// index. The indexing, caching and the browse and clone actions are shared.
+type RepositoryProvider interface {
+	// Label is shown in front of every action, eg. "[bitbucket[]"
+	Label() string
+	// Keywords are added to the search strings of every repository
+	Keywords() []string
+	CloneSettings() CloneSettings
+	// ListRepositories returns all repositories without their README
+	ListRepositories() ([]HostedRepository, error)
+	// GetReadmeText looks for a README in the root of the default branch and
+	// returns its text without markup, or "" if there is none.
+	GetReadmeText(repository HostedRepository) (string, error)
+}
+
+// RepositoryIndex is implemented by the modules that cache hosted
+// repositories, so other modules can look them up.
+type RepositoryIndex interface {
+	Keywords() []string
+	HostedRepositories() []HostedRepository
+}
+
+// HostedRepository is a repository as known to the shared indexing layer
+type HostedRepository struct {
+	Name     string `json:"name"`
+	FullName string `json:"fullName"`
+	// Project is the display name of the project (or workspace)
+	Project       string      `json:"project"`
+	ProjectKey    string      `json:"projectKey"`
+	Slug          string      `json:"slug"`
+	DefaultBranch string      `json:"defaultBranch"`
+	WebUrl        string      `json:"webUrl"`
+	CloneLinks    []CloneLink `json:"cloneLinks"`
+	// Host and Workspace are used for the clone root placeholders
+	Host      string `json:"host"`
+	Workspace string `json:"workspace"`
+	UpdatedOn string `json:"updatedOn,omitempty"`
+	// Topics (or labels) of the repository, if the host supports them
+	Topics []string `json:"topics,omitempty"`
+	Readme string   `json:"readme"`
+}
+
+// forEachConcurrently calls f for 0 <= i < n in parallel and waits for all of
+// them to return.
+func forEachConcurrently(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// IndexRepositories lists all repositories of the provider and loads their
+// READMEs.
+func IndexRepositories(provider RepositoryProvider) []HostedRepository {
+	repositories, err := provider.ListRepositories()
+	if err != nil {
+		log.Fatalf("Cannot list repositories: %v", err)
+	}
+	fmt.Printf("  - Analyzing %d repositories\n", len(repositories))
+	forEachConcurrently(len(repositories), func(i int) {
+		readme, err := provider.GetReadmeText(repositories[i])
+		if err != nil {
+			fmt.Printf("  ! Cannot get README of %s: %v\n", repositories[i].FullName, err)
+		}
+		repositories[i].Readme = readme
+	})
+	return repositories
+}
+
+// NewRepositories returns the repositories that are not in previous. Without
+// previous repositories, there was no cache to compare with, so nothing is new.
+func NewRepositories(previous []HostedRepository, current []HostedRepository) []HostedRepository {
+	if len(previous) == 0 {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, repo := range previous {
+		known[repo.FullName] = true
+	}
+	var newRepos []HostedRepository
+	for _, repo := range current {
+		if !known[repo.FullName] {
+			newRepos = append(newRepos, repo)
+		}
+	}
+	return newRepos
+}
+
+// RepositoryNotification lists repositories as markdown links
+func RepositoryNotification(title string, iconUrl string, repositories []HostedRepository) Notification {
+	text := ""
+	for _, repo := range repositories {
+		text = text + "- [" + repo.Name + "](" + repo.WebUrl + ")\\n"
+	}
+	return Notification{
+		Title:   title,
+		Text:    text,
+		IconUrl: iconUrl,
+	}
+}
+
+func writeRepositoryCache(file *os.File, data interface{}) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		log.Fatalf("Cannot serialize repository data: %s", err)
+	}
+	if _, err = file.Write(bytes); err != nil {
+		log.Fatalf("Cannot write repository data to %v: %s", file, err)
+	}
+}
+
+// readRepositoryCache reads the cached repositories into target. Caches
+// written before the repositories were shared between the providers have no
+// full names, so we ask for an update.
+func readRepositoryCache(data []byte, target interface{}, fullNames func() []string) error {
+	if err := json.Unmarshal(data, target); err != nil {
+		return err
+	}
+	for _, fullName := range fullNames() {
+		if fullName == "" {
+			return fmt.Errorf("outdated repository cache")
+		}
+	}
+	return nil
+}
+
+// repositorySearchStrings are the strings we match against for every action
+// of a repository
+func repositorySearchStrings(provider RepositoryProvider, repo HostedRepository, verb string) []string {
+	strs := append([]string{}, provider.Keywords()...)
+	strs = append(strs, verb, repo.Name, repo.Readme, repo.Project)
+	return append(strs, repo.Topics...)
+}
+
+// CreateRepositoryActions returns the browse and clone actions of a repository.
+// extraStrs are matched in addition to the default search strings.
+func CreateRepositoryActions(provider RepositoryProvider, repo HostedRepository, tags []Tag, extraStrs []string) []action {
+	var actions []action
+	if DoMatch(append(repositorySearchStrings(provider, repo, "browse"), extraStrs...), tags) {
+		actions = append(actions, RepositoryBrowseAction{label: provider.Label(), repo: repo})
+	}
+	if DoMatch(append(repositorySearchStrings(provider, repo, "clone"), extraStrs...), tags) {
+		actions = append(actions, RepositoryCloneAction{label: provider.Label(), repo: repo, cloneSettings: provider.CloneSettings()})
+	}
+	return actions
+}
+
+// CloneTarget of the repository at the given branch. An empty branch means the
+// configured clone branch.
+func (r HostedRepository) CloneTarget(cloneSettings CloneSettings, branch string) (CloneTarget, error) {
+	cloneUrl, err := gitModule.SelectCloneUrl(r.CloneLinks, cloneSettings)
+	if err != nil {
+		return CloneTarget{}, err
+	}
+	return CloneTarget{
+		Url:              cloneUrl,
+		Host:             r.Host,
+		Workspace:        r.Workspace,
+		Project:          r.ProjectKey,
+		Repo:             r.Slug,
+		Branch:           branch,
+		CredentialHelper: cloneSettings.CredentialHelper,
+	}, nil
+}
+
+type RepositoryBrowseAction struct {
+	label string
+	repo  HostedRepository
+}
+
+func (r RepositoryBrowseAction) GetLabel() string {
+	return r.label + " BROWSE " + r.repo.Name
+}
+
+func (r RepositoryBrowseAction) Run() string {
+	if err := launchUrl(r.repo.WebUrl); err != nil {
+		log.Fatalf("Could not browse %s: %v", r.repo.WebUrl, err)
+	}
+	return "Opened " + r.repo.WebUrl
+}
+
+type RepositoryCloneAction struct {
+	label         string
+	repo          HostedRepository
+	cloneSettings CloneSettings
+}
+
+func (r RepositoryCloneAction) GetLabel() string {
+	return r.label + " CLONE " + r.repo.Name
+}
+
+func (r RepositoryCloneAction) Run() string {
+	target, err := r.repo.CloneTarget(r.cloneSettings, "")
+	if err != nil {
+		log.Fatalf("Cannot clone repo %s: %v", r.repo.Name, err)
+	}
+	message, err := gitModule.Clone(target)
+	if err != nil {
+		log.Fatalf("Could not clone %s: %v", target.Url, err)
+	}
+	return message
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/spf13/viper"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SonarQubeModule indexes the projects of a sonarqube server or sonarcloud
+// with their quality gate status and key metrics.
+type SonarQubeModule struct {
+	httpUrl            string
+	token              string
+	organization       string
+	api                *ApiClient
+	projects           []SonarQubeProject
+	indexes            []RepositoryIndex
+	notificationModule *DelegatingNotificationsModule
+	// repositoriesByKey are the hosted repositories by normalized name, see
+	// repository()
+	repositoriesByKey map[string]sonarQubeRepository
+}
+
+type SonarQubeProject struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	// Gate is the quality gate status: OK, WARN, ERROR or empty if the
+	// project was never analyzed
+	Gate            string `json:"gate"`
+	Coverage        string `json:"coverage"`
+	Bugs            string `json:"bugs"`
+	CodeSmells      string `json:"codeSmells"`
+	Vulnerabilities string `json:"vulnerabilities"`
+}
+
+type sonarQubeRepository struct {
+	repo HostedRepository
+	host string
+}
+
+type sonarQubeComponentsPage struct {
+	Paging struct {
+		PageIndex int `json:"pageIndex"`
+		PageSize  int `json:"pageSize"`
+		Total     int `json:"total"`
+	} `json:"paging"`
+	Components []struct {
+		Key  string `json:"key"`
+		Name string `json:"name"`
+	} `json:"components"`
+}
+
+type sonarQubeMeasures struct {
+	Measures []struct {
+		Metric    string `json:"metric"`
+		Value     string `json:"value"`
+		Component string `json:"component"`
+	} `json:"measures"`
+}
+
+const sonarQubeMetrics = "alert_status,coverage,bugs,code_smells,vulnerabilities"
+
+// sonarQubeMeasuresBatch is the maximum number of projects per measures request
+const sonarQubeMeasuresBatch = 100
+
+func NewSonarQubeModule(notificationModule *DelegatingNotificationsModule, indexes []RepositoryIndex) *SonarQubeModule {
+	s := new(SonarQubeModule)
+	s.notificationModule = notificationModule
+	s.indexes = indexes
+	return s
+}
+
+func (s *SonarQubeModule) Name() string {
+	return "SonarQube"
+}
+
+func (s *SonarQubeModule) Description() string {
+	return "Provides access to sonarqube projects"
+}
+
+func (s *SonarQubeModule) CanBeDisabled() bool {
+	return true
+}
+
+func (s *SonarQubeModule) UpdateSettings() {
+	configKey := s.Name() + ".http-url"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'https://sonar.example.com')", configKey)
+	}
+	s.httpUrl = strings.TrimSuffix(viper.GetString(configKey), "/")
+
+	configKey = s.Name() + ".token"
+	if !viper.IsSet(configKey) {
+		log.Fatalf("Missing configuration key `%s` (eg. 'squ_...')", configKey)
+	}
+	s.token = viper.GetString(configKey)
+	// Only needed for sonarcloud
+	s.organization = viper.GetString(s.Name() + ".organization")
+	// Tokens are sent as user name without password
+	s.api = NewApiClient(s.Name(), BasicAuth(s.token, ""))
+}
+
+func (s *SonarQubeModule) NeedsExternalData() bool {
+	return true
+}
+
+func (s *SonarQubeModule) UpdateExternalData() {
+	projects, err := s.ListProjects()
+	if err != nil {
+		log.Fatalf("Cannot list sonarqube projects: %v", err)
+	}
+	if err = s.LoadMeasures(projects); err != nil {
+		log.Fatalf("Cannot get sonarqube measures: %v", err)
+	}
+	if changes := s.GateChanges(projects); changes != "" {
+		s.notificationModule.AddNotification(Notification{
+			Title:   "Quality gates changed",
+			Text:    changes,
+			IconUrl: s.httpUrl + "/apple-touch-icon.png",
+		})
+	}
+	s.projects = projects
+}
+
+// ListProjects lists all projects the user can browse
+func (s *SonarQubeModule) ListProjects() ([]SonarQubeProject, error) {
+	var projects []SonarQubeProject
+	query := url.Values{}
+	query.Set("qualifiers", "TRK")
+	query.Set("ps", "500")
+	if s.organization != "" {
+		query.Set("organization", s.organization)
+	}
+	for pageIndex := 1; ; pageIndex++ {
+		query.Set("p", strconv.Itoa(pageIndex))
+		var page sonarQubeComponentsPage
+		if _, err := s.api.GetJson(s.httpUrl+"/api/components/search?"+query.Encode(), &page); err != nil {
+			return nil, err
+		}
+		for _, component := range page.Components {
+			projects = append(projects, SonarQubeProject{Key: component.Key, Name: component.Name})
+		}
+		if len(page.Components) == 0 || page.Paging.PageIndex*page.Paging.PageSize >= page.Paging.Total {
+			return projects, nil
+		}
+	}
+}
+
+// LoadMeasures sets the quality gate status and metrics of the projects
+func (s *SonarQubeModule) LoadMeasures(projects []SonarQubeProject) error {
+	byKey := make(map[string]*SonarQubeProject)
+	for i := range projects {
+		byKey[projects[i].Key] = &projects[i]
+	}
+	for start := 0; start < len(projects); start += sonarQubeMeasuresBatch {
+		end := start + sonarQubeMeasuresBatch
+		if end > len(projects) {
+			end = len(projects)
+		}
+		var keys []string
+		for _, project := range projects[start:end] {
+			keys = append(keys, project.Key)
+		}
+		query := url.Values{}
+		query.Set("projectKeys", strings.Join(keys, ","))
+		query.Set("metricKeys", sonarQubeMetrics)
+		var measures sonarQubeMeasures
+		if _, err := s.api.GetJson(s.httpUrl+"/api/measures/search?"+query.Encode(), &measures); err != nil {
+			return err
+		}
+		for _, measure := range measures.Measures {
+			project := byKey[measure.Component]
+			if project == nil {
+				continue
+			}
+			switch measure.Metric {
+			case "alert_status":
+				project.Gate = measure.Value
+			case "coverage":
+				project.Coverage = measure.Value
+			case "bugs":
+				project.Bugs = measure.Value
+			case "code_smells":
+				project.CodeSmells = measure.Value
+			case "vulnerabilities":
+				project.Vulnerabilities = measure.Value
+			}
+		}
+	}
+	return nil
+}
+
+// GateChanges lists the projects whose quality gate status changed since the
+// previous update as markdown list.
+func (s *SonarQubeModule) GateChanges(projects []SonarQubeProject) string {
+	previousGates := make(map[string]string)
+	for _, previous := range s.projects {
+		previousGates[previous.Key] = previous.Gate
+	}
+	text := ""
+	for _, project := range projects {
+		previousGate := previousGates[project.Key]
+		if project.Gate != "" && previousGate != "" && project.Gate != previousGate {
+			text = text + "- [" + project.Name + "](" + s.dashboardUrl(project) + ") is " + sonarQubeGateState(project.Gate) +
+				" (was " + sonarQubeGateState(previousGate) + ")\\n"
+		}
+	}
+	return text
+}
+
+// sonarQubeGateState is the status as used in tags, eg. `gate:failed`
+func sonarQubeGateState(gate string) string {
+	switch gate {
+	case "OK":
+		return "passed"
+	case "WARN":
+		return "warning"
+	case "ERROR":
+		return "failed"
+	default:
+		return "none"
+	}
+}
+
+func (s *SonarQubeModule) WriteExternalData(file *os.File) {
+	bytes, err := json.Marshal(s.projects)
+	if err != nil {
+		log.Fatalf("Cannot serialize sonarqube projects: %s", err)
+	}
+	if _, err = file.Write(bytes); err != nil {
+		log.Fatalf("Cannot write sonarqube projects to %v: %s", file, err)
+	}
+}
+
+func (s *SonarQubeModule) ReadExternalData(data []byte) error {
+	return json.Unmarshal(data, &s.projects)
+}
+
+func (s *SonarQubeModule) dashboardUrl(project SonarQubeProject) string {
+	return s.httpUrl + "/dashboard?id=" + url.QueryEscape(project.Key)
+}
+
+// repository finds the hosted repository of a project. Project keys are
+// usually the repository slug, maybe prefixed like `com.example:slug` or, on
+// sonarcloud, `workspace_slug`.
+func (s *SonarQubeModule) repository(project SonarQubeProject) (sonarQubeRepository, bool) {
+	if s.repositoriesByKey == nil {
+		s.repositoriesByKey = make(map[string]sonarQubeRepository)
+		for _, index := range s.indexes {
+			host := index.Keywords()[0]
+			for _, repo := range index.HostedRepositories() {
+				for _, key := range []string{repo.Slug, repo.FullName, repo.ProjectKey + "_" + repo.Slug} {
+					s.repositoriesByKey[strings.ToLower(key)] = sonarQubeRepository{repo: repo, host: host}
+				}
+			}
+		}
+	}
+	key := strings.ToLower(project.Key)
+	candidates := []string{key, key[strings.LastIndex(key, ":")+1:], strings.ReplaceAll(key, ":", "/")}
+	for _, candidate := range candidates {
+		if repository, found := s.repositoriesByKey[candidate]; found {
+			return repository, true
+		}
+	}
+	return sonarQubeRepository{}, false
+}
+
+func (p SonarQubeProject) label(verb string) string {
+	label := "[sonar[] " + verb + " " + p.Name + " gate:" + sonarQubeGateState(p.Gate)
+	if p.Coverage != "" {
+		label += " coverage " + p.Coverage + "%"
+	}
+	if p.Bugs != "" {
+		label += " bugs " + p.Bugs
+	}
+	if p.CodeSmells != "" {
+		label += " smells " + p.CodeSmells
+	}
+	return label
+}
+
+type SonarQubeBrowseAction struct {
+	label string
+	url   string
+}
+
+func (s SonarQubeBrowseAction) GetLabel() string {
+	return s.label
+}
+
+func (s SonarQubeBrowseAction) Run() string {
+	if err := launchUrl(s.url); err != nil {
+		log.Fatalf("Could not browse %s: %v", s.url, err)
+	}
+	return "Opened " + s.url
+}
+
+func (s *SonarQubeModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	for _, project := range s.projects {
+		strs := []string{"sonar", "sonarqube", "quality", project.Key, project.Name, "gate:" + sonarQubeGateState(project.Gate)}
+		repository, hasRepository := s.repository(project)
+		if hasRepository {
+			strs = append(strs, repository.host, repository.repo.Name, repository.repo.FullName, repository.repo.Project)
+		}
+		if DoMatch(append(strs, "browse"), tags) {
+			actions = append(actions, SonarQubeBrowseAction{label: project.label("BROWSE"), url: s.dashboardUrl(project)})
+		}
+		if hasRepository && DoMatch(append(strs, "repository"), tags) {
+			actions = append(actions, SonarQubeBrowseAction{
+				label: project.label("REPOSITORY") + " " + repository.host + ":" + repository.repo.FullName,
+				url:   repository.repo.WebUrl,
+			})
+		}
+	}
+	return actions
+}
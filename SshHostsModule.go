@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// SshHostsModule offers the hosts of the ssh config and, optionally, of the
+// known hosts. The files are read on every start, so there is nothing to
+// update.
+type SshHostsModule struct {
+	configFile     string
+	knownHostsFile string
+	knownHosts     bool
+	terminal       string
+	hosts          []SshHost
+	loaded         bool
+}
+
+type SshHost struct {
+	// Alias is the name to pass to ssh, eg. the `Host` of the config
+	Alias    string
+	HostName string
+	User     string
+	Port     string
+	// Known is true for hosts that are only in the known hosts
+	Known bool
+}
+
+// sshHostBlock is a `Host` section of the ssh config
+type sshHostBlock struct {
+	patterns []string
+	// options are lowercase keywords with the first value, as ssh uses the
+	// first value it finds
+	options map[string]string
+	// within are the patterns of the Host blocks the block was included in.
+	// They have to match, too.
+	within [][]string
+}
+
+// matches is true if the block applies to the alias
+func (b sshHostBlock) matches(alias string) bool {
+	if !sshHostMatches(b.patterns, alias) {
+		return false
+	}
+	for _, patterns := range b.within {
+		if !sshHostMatches(patterns, alias) {
+			return false
+		}
+	}
+	return true
+}
+
+// sshMaxIncludeDepth stops include loops
+const sshMaxIncludeDepth = 16
+
+func NewSshHostsModule() *SshHostsModule {
+	return new(SshHostsModule)
+}
+
+func (s *SshHostsModule) Name() string {
+	return "SshHosts"
+}
+
+func (s *SshHostsModule) Description() string {
+	return "Provides ssh sessions to the hosts of the ssh config"
+}
+
+func (s *SshHostsModule) CanBeDisabled() bool {
+	return true
+}
+
+func (s *SshHostsModule) UpdateSettings() {
+	s.configFile = "~/.ssh/config"
+	if configKey := s.Name() + ".config"; viper.IsSet(configKey) {
+		s.configFile = viper.GetString(configKey)
+	}
+	s.knownHostsFile = "~/.ssh/known_hosts"
+	if configKey := s.Name() + ".known-hosts-file"; viper.IsSet(configKey) {
+		s.knownHostsFile = viper.GetString(configKey)
+	}
+	s.knownHosts = viper.GetBool(s.Name() + ".known-hosts")
+	s.terminal = viper.GetString(s.Name() + ".terminal")
+	if s.terminal == "" {
+		switch runtime.GOOS {
+		case "windows":
+			s.terminal = "start cmd /k {command}"
+		case "darwin":
+			s.terminal = `osascript -e 'tell application "Terminal" to do script "{command}"'`
+		default: // "linux", "freebsd", "openbsd", "netbsd"
+			s.terminal = "x-terminal-emulator -e {command}"
+		}
+	}
+}
+
+func (s *SshHostsModule) NeedsExternalData() bool {
+	return false
+}
+
+func (s *SshHostsModule) UpdateExternalData() {
+	// this intentionally empty
+}
+
+func (s *SshHostsModule) WriteExternalData(_ *os.File) {
+	// this intentionally empty
+}
+
+func (s *SshHostsModule) ReadExternalData(_ []byte) error {
+	// this intentionally empty
+	return nil
+}
+
+// Hosts reads the ssh config and the known hosts on first use
+func (s *SshHostsModule) Hosts() []SshHost {
+	if s.loaded {
+		return s.hosts
+	}
+	s.loaded = true
+	sshDir, err := homedir.Expand("~/.ssh")
+	if err != nil {
+		log.Fatalf("Cannot find ssh directory: %v", err)
+	}
+	var blocks []sshHostBlock
+	if configFile, err := homedir.Expand(s.configFile); err == nil {
+		blocks = readSshConfig(configFile, sshDir, 0)
+	}
+	s.hosts = sshConfigHosts(blocks)
+	if s.knownHosts {
+		if knownHostsFile, err := homedir.Expand(s.knownHostsFile); err == nil {
+			s.hosts = append(s.hosts, readKnownHosts(knownHostsFile, s.hosts)...)
+		}
+	}
+	return s.hosts
+}
+
+// readSshConfig returns the host blocks of a config file with its includes.
+// Options before the first `Host` apply to all hosts. An `Include` in a `Host`
+// block only applies to the hosts of that block. `Match` blocks are skipped,
+// since we cannot evaluate them.
+func readSshConfig(fileName string, sshDir string, depth int) []sshHostBlock {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Fatalf("Could not close %s: %v", fileName, err)
+		}
+	}()
+	blocks := []sshHostBlock{{patterns: []string{"*"}, options: make(map[string]string)}}
+	// current is the index of the block that gets the options
+	current := 0
+	skipping := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		keyword, args := sshConfigLine(scanner.Text())
+		switch keyword {
+		case "":
+		case "host":
+			blocks = append(blocks, sshHostBlock{patterns: args, options: make(map[string]string)})
+			current = len(blocks) - 1
+			skipping = false
+		case "match":
+			skipping = true
+		case "include":
+			if skipping || depth >= sshMaxIncludeDepth {
+				continue
+			}
+			for _, include := range args {
+				for _, includedFile := range sshIncludedFiles(include, sshDir) {
+					included := readSshConfig(includedFile, sshDir, depth+1)
+					if len(included) == 0 {
+						continue
+					}
+					// The options before the first Host of the included file
+					// belong to the current block. After the include, the
+					// current block continues, like in ssh.
+					for keyword, value := range included[0].options {
+						if _, set := blocks[current].options[keyword]; !set {
+							blocks[current].options[keyword] = value
+						}
+					}
+					// The Host blocks of a file included in a Host block only
+					// apply to the hosts of that block
+					for _, block := range included[1:] {
+						if current > 0 {
+							within := append([][]string{}, blocks[current].within...)
+							within = append(within, blocks[current].patterns)
+							block.within = append(within, block.within...)
+						}
+						blocks = append(blocks, block)
+					}
+				}
+			}
+		default:
+			if _, set := blocks[current].options[keyword]; !set && !skipping && len(args) > 0 {
+				blocks[current].options[keyword] = args[0]
+			}
+		}
+	}
+	return blocks
+}
+
+// sshConfigLine splits a line into the lowercase keyword and its arguments
+func sshConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	// Keyword and arguments may be separated by `=`
+	if i := strings.IndexAny(line, " \t="); i > 0 {
+		keyword := strings.ToLower(line[:i])
+		rest := strings.TrimLeft(line[i:], " \t=")
+		var args []string
+		for _, arg := range strings.Fields(rest) {
+			args = append(args, strings.Trim(arg, `"`))
+		}
+		return keyword, args
+	}
+	return strings.ToLower(line), nil
+}
+
+// sshIncludedFiles expands an include. Relative paths are relative to the
+// ssh directory.
+func sshIncludedFiles(include string, sshDir string) []string {
+	include, err := homedir.Expand(include)
+	if err != nil {
+		return nil
+	}
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(sshDir, include)
+	}
+	files, err := filepath.Glob(include)
+	if err != nil {
+		return nil
+	}
+	return files
+}
+
+// sshConfigHosts returns a host for every alias without wildcards, with the
+// options of all blocks that match it.
+func sshConfigHosts(blocks []sshHostBlock) []SshHost {
+	var hosts []SshHost
+	found := make(map[string]bool)
+	for _, block := range blocks {
+		for _, pattern := range block.patterns {
+			if found[pattern] || strings.HasPrefix(pattern, "!") || strings.ContainsAny(pattern, "*?") || !block.matches(pattern) {
+				continue
+			}
+			found[pattern] = true
+			host := SshHost{Alias: pattern}
+			for _, matching := range blocks {
+				if !matching.matches(pattern) {
+					continue
+				}
+				if host.HostName == "" {
+					// %h is the only token worth expanding for a label
+					host.HostName = strings.ReplaceAll(matching.options["hostname"], "%h", pattern)
+				}
+				if host.User == "" {
+					host.User = matching.options["user"]
+				}
+				if host.Port == "" {
+					host.Port = matching.options["port"]
+				}
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// sshHostMatches is true if a pattern matches the alias and no negated pattern
+// does
+func sshHostMatches(patterns []string, alias string) bool {
+	matches := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if matched, _ := path.Match(strings.ToLower(strings.TrimPrefix(pattern, "!")), strings.ToLower(alias)); matched {
+			if negated {
+				return false
+			}
+			matches = true
+		}
+	}
+	return matches
+}
+
+// readKnownHosts returns the hosts of the known hosts file that are not known
+// otherwise. Hashed entries cannot be read.
+func readKnownHosts(fileName string, known []SshHost) []SshHost {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Fatalf("Could not close %s: %v", fileName, err)
+		}
+	}()
+	found := make(map[string]bool)
+	for _, host := range known {
+		found[host.Alias] = true
+		found[host.HostName] = true
+	}
+	var hosts []SshHost
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "|") {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "@") {
+			// @cert-authority or @revoked
+			continue
+		}
+		for _, name := range strings.Split(fields[0], ",") {
+			host := SshHost{Alias: name, Known: true}
+			// Non standard ports are written as [host]:port
+			if strings.HasPrefix(name, "[") {
+				if end := strings.Index(name, "]:"); end > 0 {
+					host.Alias = name[1:end]
+					host.Port = name[end+2:]
+				}
+			}
+			if found[host.Alias] || strings.ContainsAny(host.Alias, "*?") {
+				continue
+			}
+			found[host.Alias] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Command is the ssh command line for the host
+func (h SshHost) Command() string {
+	command := "ssh "
+	if h.Known && h.Port != "" {
+		command += "-p " + h.Port + " "
+	}
+	return command + h.Alias
+}
+
+func (h SshHost) label(verb string) string {
+	label := "[ssh[] " + verb + " " + h.Alias
+	target := h.HostName
+	if h.User != "" {
+		target = h.User + "@" + target
+	}
+	if h.HostName != "" && h.HostName != h.Alias {
+		label += " (" + target + ")"
+	}
+	return label
+}
+
+type SshSessionAction struct {
+	host SshHost
+}
+
+func (s SshSessionAction) GetLabel() string {
+	return s.host.label("SSH")
+}
+
+// Run starts ssh in the current terminal
+func (s SshSessionAction) Run() string {
+	args := strings.Fields(s.host.Command())
+	proc := exec.Command(args[0], args[1:]...)
+	proc.Stdin = os.Stdin
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	if err := proc.Run(); err != nil {
+		return "ssh " + s.host.Alias + " failed: " + err.Error()
+	}
+	return "Closed ssh session to " + s.host.Alias
+}
+
+type SshTerminalAction struct {
+	host     SshHost
+	terminal string
+}
+
+func (s SshTerminalAction) GetLabel() string {
+	return s.host.label("TERMINAL")
+}
+
+func (s SshTerminalAction) Run() string {
+	command := strings.ReplaceAll(s.terminal, "{command}", s.host.Command())
+	if err := runShell("", command); err != nil {
+		log.Fatalf("Could not open terminal with %s: %v", command, err)
+	}
+	return "Opened ssh session to " + s.host.Alias
+}
+
+type SshCopyAction struct {
+	host SshHost
+}
+
+func (s SshCopyAction) GetLabel() string {
+	return s.host.label("COPY")
+}
+
+// Run copies the command. Without a clipboard, it is printed instead.
+func (s SshCopyAction) Run() string {
+	command := s.host.Command()
+	if err := copyToClipboard(command); err != nil {
+		return command
+	}
+	return fmt.Sprintf("Copied `%s`", command)
+}
+
+func (s *SshHostsModule) CreateActions(tags []Tag) []action {
+	var actions []action
+	for _, host := range s.Hosts() {
+		strs := []string{"ssh", host.Alias, host.HostName, host.User}
+		if DoMatch(strs, tags) {
+			actions = append(actions, SshSessionAction{host: host})
+		}
+		if DoMatch(append(strs, "terminal"), tags) {
+			actions = append(actions, SshTerminalAction{host: host, terminal: s.terminal})
+		}
+		if DoMatch(append(strs, "copy"), tags) {
+			actions = append(actions, SshCopyAction{host: host})
+		}
+	}
+	return actions
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeSshTestFile(t *testing.T, fileName string, content string) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSshConfigLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		wantKeyword string
+		wantArgs    []string
+	}{
+		{"", "", nil},
+		{"   # comment", "", nil},
+		{"Host web web.prod", "host", []string{"web", "web.prod"}},
+		{"  HostName=web.example.com", "hostname", []string{"web.example.com"}},
+		{"Port = 2222", "port", []string{"2222"}},
+		{"\tUser\t\"deploy\"", "user", []string{"deploy"}},
+		{"ForwardAgent", "forwardagent", nil},
+	}
+	for _, test := range tests {
+		keyword, args := sshConfigLine(test.line)
+		if keyword != test.wantKeyword || !reflect.DeepEqual(args, test.wantArgs) {
+			t.Errorf("sshConfigLine(%q) = %q, %q, want %q, %q", test.line, keyword, args, test.wantKeyword, test.wantArgs)
+		}
+	}
+}
+
+func TestSshHostMatches(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		alias    string
+		want     bool
+	}{
+		{[]string{"web"}, "web", true},
+		{[]string{"web"}, "WEB", true},
+		{[]string{"web"}, "web.prod", false},
+		{[]string{"*"}, "web", true},
+		{[]string{"*.prod"}, "web.prod", true},
+		{[]string{"*.prod"}, "web.test", false},
+		{[]string{"web?"}, "web1", true},
+		{[]string{"web?"}, "web10", false},
+		{[]string{"web", "db"}, "db", true},
+		{[]string{"*.prod", "!db.prod"}, "web.prod", true},
+		{[]string{"*.prod", "!db.prod"}, "db.prod", false},
+		{[]string{"!db.prod", "*.prod"}, "db.prod", false},
+		{[]string{"!db.prod"}, "web.prod", false},
+		{nil, "web", false},
+	}
+	for _, test := range tests {
+		if got := sshHostMatches(test.patterns, test.alias); got != test.want {
+			t.Errorf("sshHostMatches(%q, %q) = %v, want %v", test.patterns, test.alias, got, test.want)
+		}
+	}
+}
+
+func TestReadSshConfig(t *testing.T) {
+	sshDir := t.TempDir()
+	writeSshTestFile(t, filepath.Join(sshDir, "config"), `# Options for all hosts
+ServerAliveInterval 60
+Include config.d/*.conf
+
+Host web web.prod
+    HostName=%h.example.com
+    Port 2222
+
+Host *.prod !db.prod
+    User deploy
+
+Host db.prod
+    HostName 10.0.0.5
+    User "dba"
+
+Match host *.internal
+    User ignored
+    Include ignored.conf
+
+Host *
+    User fallback
+    Port 22
+`)
+	writeSshTestFile(t, filepath.Join(sshDir, "config.d", "10-jump.conf"), `Host jump
+    HostName jump.example.com
+    User ops
+    User ignored
+`)
+	writeSshTestFile(t, filepath.Join(sshDir, "config.d", "README"), `Host not-included
+`)
+	writeSshTestFile(t, filepath.Join(sshDir, "ignored.conf"), `Host from-match-block
+`)
+
+	hosts := sshConfigHosts(readSshConfig(filepath.Join(sshDir, "config"), sshDir, 0))
+	want := []SshHost{
+		{Alias: "jump", HostName: "jump.example.com", User: "ops", Port: "22"},
+		{Alias: "web", HostName: "web.example.com", User: "fallback", Port: "2222"},
+		{Alias: "web.prod", HostName: "web.prod.example.com", User: "deploy", Port: "2222"},
+		{Alias: "db.prod", HostName: "10.0.0.5", User: "dba", Port: "22"},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("sshConfigHosts() = %+v, want %+v", hosts, want)
+	}
+}
+
+func TestReadSshConfigIncludeInHostBlock(t *testing.T) {
+	// The Host blocks of the included files only apply to the bastion hosts
+	sshDir := t.TempDir()
+	writeSshTestFile(t, filepath.Join(sshDir, "config"), `Host bastion-*
+    Include hosts.d/*.conf
+
+Host web
+    HostName web.example.com
+`)
+	writeSshTestFile(t, filepath.Join(sshDir, "hosts.d", "bastion.conf"), `Host bastion-eu
+    HostName eu.example.com
+
+Host bastion-u*
+    Include nested.conf
+
+Host db
+    HostName db.example.com
+
+Host *
+    User ops
+`)
+	writeSshTestFile(t, filepath.Join(sshDir, "nested.conf"), `Host bastion-us bastion-eu2
+    Port 2200
+`)
+
+	hosts := sshConfigHosts(readSshConfig(filepath.Join(sshDir, "config"), sshDir, 0))
+	want := []SshHost{
+		{Alias: "bastion-eu", HostName: "eu.example.com", User: "ops"},
+		{Alias: "bastion-us", User: "ops", Port: "2200"},
+		{Alias: "web", HostName: "web.example.com"},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("sshConfigHosts() = %+v, want %+v", hosts, want)
+	}
+}
+
+func TestReadSshConfigIncludeLoop(t *testing.T) {
+	sshDir := t.TempDir()
+	writeSshTestFile(t, filepath.Join(sshDir, "config"), `Include config
+Host web
+`)
+	hosts := sshConfigHosts(readSshConfig(filepath.Join(sshDir, "config"), sshDir, 0))
+	if len(hosts) != 1 || hosts[0].Alias != "web" {
+		t.Errorf("sshConfigHosts() = %+v, want only web", hosts)
+	}
+}
+
+func TestReadSshConfigMissingFile(t *testing.T) {
+	sshDir := t.TempDir()
+	if blocks := readSshConfig(filepath.Join(sshDir, "config"), sshDir, 0); blocks != nil {
+		t.Errorf("readSshConfig() = %+v, want nil", blocks)
+	}
+}
+
+func TestReadKnownHosts(t *testing.T) {
+	sshDir := t.TempDir()
+	fileName := filepath.Join(sshDir, "known_hosts")
+	writeSshTestFile(t, fileName, `# comment
+github.com,140.82.121.4 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+[git.example.com]:7999 ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC
+|1|JfKTdBh7rNbXkVAQCRp4OQoPfmI=|USECr3SWf1JUPsms5AqfD5QfxkM= ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC
+@cert-authority *.example.com ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC
+web.example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+jump ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+*.wildcard.example.com ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC
+github.com ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg=
+malformed
+`)
+	known := []SshHost{{Alias: "jump"}, {Alias: "web", HostName: "web.example.com"}}
+	hosts := readKnownHosts(fileName, known)
+	want := []SshHost{
+		{Alias: "github.com", Known: true},
+		{Alias: "140.82.121.4", Known: true},
+		{Alias: "git.example.com", Port: "7999", Known: true},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("readKnownHosts() = %+v, want %+v", hosts, want)
+	}
+	if command := hosts[2].Command(); command != "ssh -p 7999 git.example.com" {
+		t.Errorf("Command() = %q", command)
+	}
+}
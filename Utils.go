@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 )
 
 // From https://stackoverflow.com/a/39324149
@@ -26,7 +27,7 @@ func launchUrl(url string) error {
 }
 
 // From https://stackoverflow.com/a/39324149
-func runGitClone(url string) error {
+func gitCommand(dir string, gitArgs ...string) *exec.Cmd {
 	var cmd string
 	var args []string
 
@@ -39,8 +40,66 @@ func runGitClone(url string) error {
 	default: // "linux", "freebsd", "openbsd", "netbsd"
 		cmd = "git"
 	}
-	args = append(args, "clone", url)
+	args = append(args, gitArgs...)
 	proc := exec.Command(cmd, args...)
+	proc.Dir = dir
+	return proc
+}
+
+func runGit(dir string, gitArgs ...string) error {
+	proc := gitCommand(dir, gitArgs...)
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	return proc.Run()
+}
+
+// gitOutput runs git and returns what it printed to stdout
+func gitOutput(dir string, gitArgs ...string) (string, error) {
+	proc := gitCommand(dir, gitArgs...)
+	proc.Stderr = os.Stderr
+	output, err := proc.Output()
+	return string(output), err
+}
+
+// copyToClipboard hands the text to the clipboard tool of the platform
+func copyToClipboard(text string) error {
+	var proc *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		proc = exec.Command("clip")
+	case "darwin":
+		proc = exec.Command("pbcopy")
+	default: // "linux", "freebsd", "openbsd", "netbsd"
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			proc = exec.Command("wl-copy")
+		} else {
+			proc = exec.Command("xclip", "-selection", "clipboard")
+		}
+	}
+	proc.Stdin = strings.NewReader(text)
+	return proc.Run()
+}
+
+// runCommand runs a program in the terminal of the user
+func runCommand(dir string, name string, args ...string) error {
+	proc := exec.Command(name, args...)
+	proc.Dir = dir
+	proc.Stdin = os.Stdin
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	return proc.Run()
+}
+
+func runShell(dir string, command string) error {
+	var proc *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		proc = exec.Command("cmd", "/c", command)
+	default:
+		proc = exec.Command("sh", "-c", command)
+	}
+	proc.Dir = dir
+	proc.Stdin = os.Stdin
 	proc.Stdout = os.Stdout
 	proc.Stderr = os.Stderr
 	return proc.Run()
@@ -5,11 +5,9 @@ go 1.15
 require (
 	github.com/Medisafe/jenkins-api v0.0.0-20151226144414-8eee15bb1258
 	github.com/bep/debounce v1.2.0
-	github.com/dghubble/sling v1.3.0 // indirect
 	github.com/gdamore/tcell/v2 v2.0.1-0.20201017141208-acf90d56d591
 	github.com/ktrysmt/go-bitbucket v0.9.15
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/rivo/tview v0.0.0-20201204190810-5406288b8e4e
-	github.com/sne11ius/bitclient v0.0.0-20210110195654-62888517afa6
 	github.com/spf13/viper v1.7.1
 )
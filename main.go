@@ -22,6 +22,18 @@ type action interface {
 	Run() string
 }
 
+// bareOutputAction is implemented by actions whose result is meant for the
+// shell, eg. `cd "$(fu -l cd my-repo)"`. Their result is printed without
+// decoration if BareOutput returns true.
+type bareOutputAction interface {
+	BareOutput() bool
+}
+
+func isBareOutput(a action) bool {
+	bare, ok := a.(bareOutputAction)
+	return ok && bare.BareOutput()
+}
+
 var activationModule = NewActivationModule()
 var emailNotificationsModule = NewEmailNotificationsModule()
 var msTeamsNotificationsModule = NewMsTeamsNotificationsModule()
@@ -30,18 +42,53 @@ var notificationModules = []NotificationModule{
 	emailNotificationsModule,
 }
 var delegatingNotificationsModule = NewDelegatingNotificationsModule(activationModule, notificationModules)
+var gitModule = NewGitModule()
 
 var jenkinsModule = NewJenkinsModule(delegatingNotificationsModule)
 var bitbucketServerModule = NewBitbucketServerModule()
+var bitbucketServerPullRequestsModule = NewBitbucketServerPullRequestsModule(bitbucketServerModule)
 var bitbucketModule = NewBitbucketModule(delegatingNotificationsModule)
+var bitbucketPullRequestsModule = NewBitbucketPullRequestsModule(bitbucketModule)
+var gitHubModule = NewGitHubModule(delegatingNotificationsModule)
+var gitLabModule = NewGitLabModule(delegatingNotificationsModule)
+var giteaModule = NewGiteaModule(delegatingNotificationsModule)
+var localRepositoriesModule = NewLocalRepositoriesModule([]RepositoryIndex{
+	bitbucketModule,
+	bitbucketServerModule,
+	gitHubModule,
+	gitLabModule,
+	giteaModule,
+})
+var jiraModule = NewJiraModule()
+var confluenceModule = NewConfluenceModule()
+var artifactsModule = NewArtifactsModule()
+var sonarQubeModule = NewSonarQubeModule(delegatingNotificationsModule, []RepositoryIndex{
+	bitbucketModule,
+	bitbucketServerModule,
+})
+var kubernetesModule = NewKubernetesModule()
+var sshHostsModule = NewSshHostsModule()
 var timestampModule = NewTimestampModule()
 var ddgModule = NewDuckDuckGoModule()
 
 var modules = []Module{
 	activationModule,
+	gitModule,
 	jenkinsModule,
 	bitbucketServerModule,
+	bitbucketServerPullRequestsModule,
 	bitbucketModule,
+	bitbucketPullRequestsModule,
+	gitHubModule,
+	gitLabModule,
+	giteaModule,
+	localRepositoriesModule,
+	jiraModule,
+	confluenceModule,
+	artifactsModule,
+	sonarQubeModule,
+	kubernetesModule,
+	sshHostsModule,
 	timestampModule,
 	ddgModule,
 	msTeamsNotificationsModule,
@@ -87,7 +134,12 @@ func main() {
 		if *feelingLucky {
 			doRun(action)
 		} else {
-			fmt.Printf("Run %s? (Y/n) ", action.GetLabel())
+			// Keep stdout clean for `$(...)`
+			out := os.Stdout
+			if isBareOutput(action) {
+				out = os.Stderr
+			}
+			fmt.Fprintf(out, "Run %s? (Y/n) ", action.GetLabel())
 			if readBool() {
 				doRun(action)
 			}
@@ -104,7 +156,11 @@ func main() {
 			app.Stop()
 			action := actions[index]
 			message := action.Run()
-			fmt.Println("ﴪ >>> " + message)
+			if isBareOutput(action) {
+				fmt.Println(message)
+			} else {
+				fmt.Println("ﴪ >>> " + message)
+			}
 			os.Exit(0)
 		})
 	for _, action := range actions {
@@ -196,6 +252,32 @@ func readBool() bool {
 	return false
 }
 
+// confirm asks a yes/no question that defaults to "no". Use it before running
+// destructive actions.
+func confirm(question string) bool {
+	fmt.Printf("%s (y/N) ", question)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	input := strings.ToLower(strings.TrimSpace(scanner.Text()))
+	return input == "y" || input == "yes"
+}
+
+// prompt asks for a line of text. An empty answer gives the default value.
+func prompt(question string, defaultValue string) string {
+	if defaultValue != "" {
+		fmt.Printf("%s [%s] ", question, defaultValue)
+	} else {
+		fmt.Printf("%s ", question)
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	input := strings.TrimSpace(scanner.Text())
+	if input == "" {
+		return defaultValue
+	}
+	return input
+}
+
 func updateModuleSettings() {
 	home, err := homedir.Dir()
 	if err != nil {
@@ -263,9 +345,15 @@ func readCacheDataForModule(module Module) error {
 }
 
 func LocateConfigFile(module Module) string {
+	return LocateCacheFile(module.Name())
+}
+
+// LocateCacheFile returns the path of a json cache file in the furbnicator
+// config directory.
+func LocateCacheFile(name string) string {
 	home, err := homedir.Dir()
 	if err != nil {
 		log.Fatal("Error: cannot home directory")
 	}
-	return filepath.Join(home, ".config", "furbnicator", module.Name()+".json")
+	return filepath.Join(home, ".config", "furbnicator", name+".json")
 }